@@ -13,7 +13,7 @@ func parseArgs(args []string, dest interface{}) (*Object, error) {
 		return nil, fmt.Errorf("unable to parse args: bad requirements: %s", err)
 	}
 
-	out := Object{items: make(map[string]interface{})}
+	out := newObject()
 	shorts := make(map[string]req, len(reqs))
 	longs := make(map[string]req, len(reqs))
 	for _, req := range reqs {
@@ -57,7 +57,7 @@ func parseArgs(args []string, dest interface{}) (*Object, error) {
 				return nil, fmt.Errorf("unrecognized long opt: %s", key)
 			}
 			if req.t.Kind() == reflect.Bool {
-				out.items[req.name] = true
+				out.set(req.name, true, Position{})
 				continue
 			}
 
@@ -66,7 +66,7 @@ func parseArgs(args []string, dest interface{}) (*Object, error) {
 			if err != nil {
 				return nil, fmt.Errorf("unable to parse cli argument %s: %s", key, err)
 			}
-			out.items[req.name] = d.items[key]
+			out.set(req.name, d.items[key], Position{})
 		} else if strings.HasPrefix(arg, "-") {
 			arg = strings.TrimPrefix(arg, "-")
 			if strings.ContainsRune(arg, '=') {
@@ -82,11 +82,11 @@ func parseArgs(args []string, dest interface{}) (*Object, error) {
 				if !ok {
 					return nil, fmt.Errorf("unrecognized short opt: %c", runes[0])
 				}
-				d, err := ReadString(fmt.Sprintf("key: %s", runes[2:]))
+				d, err := ReadString(fmt.Sprintf("key: %s", string(runes[2:])))
 				if err != nil {
 					return nil, fmt.Errorf("unable to parse cli argument %c: %s", runes[0], err)
 				}
-				out.items[req.name] = d.items["key"]
+				out.set(req.name, d.items["key"], Position{})
 			} else {
 				runes := []rune(arg)
 				for j := 0; j < len(runes); j++ {
@@ -96,7 +96,7 @@ func parseArgs(args []string, dest interface{}) (*Object, error) {
 						return nil, fmt.Errorf("unrecognized short opt: %c", r)
 					}
 					if req.t.Kind() == reflect.Bool {
-						out.items[req.name] = true
+						out.set(req.name, true, Position{})
 						continue
 					}
 					if j != len(runes)-1 {
@@ -114,14 +114,14 @@ func parseArgs(args []string, dest interface{}) (*Object, error) {
 					if err != nil {
 						return nil, fmt.Errorf("error parsing cli arg %s: %s", req.name, err)
 					}
-					out.items[req.name] = d.items["key"]
+					out.set(req.name, d.items["key"], Position{})
 				}
 			}
 		} else {
 			break
 		}
 	}
-	return &out, nil
+	return out, nil
 }
 
 func showHelp(dest interface{}) {
@@ -81,9 +81,16 @@ check:  used to syntax check a given file.  To check a given file, in this case
 
   moon check ex.moon
 
-If the file is syntactically valid, moon will print nothing and exit with a
-status of 0.  If the file is invalid, moon will print a cryptic error message
-that won't help you fix the file and exit with a status of 1.
+If the file is valid, moon will print nothing and exit with a status of 0.  If
+the file is invalid, moon will print every problem it finds, one per line in
+the form file:line:col: message, and exit with a status of 1.
+
+Checking evaluates the document, so it reads environment variables just as eval
+does.  A check in a continuous integration system that shouldn't depend on the
+environment of the machine it runs on would use the -noenv flag, described
+below:
+
+  moon check -noenv ex.moon
 
 eval:  evaluates a given moon file.  The file is parsed and evaluated, and its result is printed on stdout, itself in the moon format.  Invoking the following command:
 
@@ -92,13 +99,30 @@ eval:  evaluates a given moon file.  The file is parsed and evaluated, and its r
 would produce the following output:
 
   first_name: "jordan"
-  items: ["one" 2 3.4 ["five" 6 7.8]]
-  other_hash: {key_3: 3.4 key_4: ["five" 6 7.8] key_1: "one" key_2: 2}
-  repeat_hash: {key: "value" other_key: "other_value"}
-  people: [{age: 28 hometown: "crooklyn" name: "the first name here"} {hometown: "tha bronx" name: "the second name here" age: 30}]
   last_name: "orelli"
+  items: ["one" 2 3.4 ["five" 6 7.8]]
   hash: {key: "value" other_key: "other_value"}
+  other_hash: {key_1: "one" key_2: 2 key_3: 3.4 key_4: ["five" 6 7.8]}
+  repeat_hash: {key: "value" other_key: "other_value"}
   visible_item: "it has a value"
+  people: [{name: "the first name here" age: 28 hometown: "crooklyn"} {name: "the second name here" age: 30 hometown: "tha bronx"}]
+
+(abbreviated here.)  Keys are printed in the order in which they are defined
+in the source document, both at the top level and within objects.
+
+Every subcommand that evaluates a document follows its %include directives.
+Included files are found relative to the including file, or relative to the
+current directory for a document read from stdin.
+
+Documents may refer to environment variables, as in ${HOME} or
+${DB_HOST:-localhost}, and may choose values by profile, as in
+%profile {dev: 1; prod: 5}.  The check, eval, get and to subcommands accept
+the following flags, given before their other arguments:
+
+  -noenv    disable environment variable lookups, so that only references with
+            defaults may be used and the output never depends on the environment
+  -profile  the name of the profile used to choose %profile values, as in
+            moon eval -profile prod ex.moon
 
 to:  used to convert moon files to other formats.  Right now, the only
 supported format is json.  To convert a given moon file to json, one would invoke the following command:
@@ -107,7 +131,8 @@ supported format is json.  To convert a given moon file to json, one would invok
 
 If the file is valid and can be converted to json (i.e., only involves types
 that are also supported by json or readily convertible to json types), the
-file's json representation will be printed on stdout.
+file's json representation will be printed on stdout, with the keys of every
+object in the order in which they were defined.
 
 The "to" subcommand can also take its input from stdin by omitting a file name, as in one of the following invocations:
 
@@ -133,7 +158,7 @@ file to be searched.  Given the moon file ex.moon:
   "it has a value"
 
   > moon get people ex.moon
-  [{hometown: "crooklyn" name: "the first name here" age: 28} {name: "the second name here" age: 30 hometown: "tha bronx"}]
+  [{name: "the first name here" age: 28 hometown: "crooklyn"} {name: "the second name here" age: 30 hometown: "tha bronx"}]
 
 The search term may involve a path, allowing one to reach into an Object or List and retrieve individual items:
 
@@ -143,55 +168,90 @@ The search term may involve a path, allowing one to reach into an Object or List
   > moon get people/1/name ex.moon
   "the second name here"
 
+fmt:  formats moon files in a canonical style, in the spirit of gofmt.  Unlike
+eval, fmt keeps comments, variables and heredocs.  Given no file names, fmt
+formats stdin and prints the result on stdout; given file names, it prints the
+formatted version of each file.  The following flags alter that behavior:
+
+  -w  write the formatted document back to its source file
+  -l  list the files whose formatting differs from fmt's
+  -d  display a diff between each file and its formatted version
+
+A typical check in a continuous integration system would be:
+
+  test -z "$(moon fmt -l *.moon)"
+
 */
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/jordanorelli/moon"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 )
 
-func input(n int) io.ReadCloser {
-	if flag.Arg(n) == "" {
-		return os.Stdin
-	} else {
-		f, err := os.Open(flag.Arg(n))
-		if err != nil {
-			bail(1, "input error: %s", err)
-		}
-		return f
+// readPath reads the moon document at path, or stdin if path is empty. Reading
+// by file name lets errors carry the file name, and lets the document include
+// other documents relative to its own location.
+func readPath(path string, opts ...moon.Option) (*moon.Object, error) {
+	if path == "" {
+		return moon.Read(os.Stdin, opts...)
 	}
+	return moon.ReadFile(path, opts...)
 }
 
 func check() {
-	r := input(1)
-	defer r.Close()
+	fs, opts := evalFlags("check")
+	var diags moon.Diagnostics
+	if fs.Arg(0) == "" {
+		diags = moon.Check(os.Stdin, opts...)
+	} else {
+		diags = moon.CheckFile(fs.Arg(0), opts...)
+	}
+	if len(diags) > 0 {
+		bail(1, "%s", diags)
+	}
+}
 
-	_, err := moon.Read(r)
-	if err != nil {
-		bail(1, "parse error: %s", err)
+// evalFlags parses the flags of a subcommand that evaluates a document, giving
+// the subcommand's remaining arguments and the options with which to read the
+// document.
+func evalFlags(name string) (*flag.FlagSet, []moon.Option) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	noenv := fs.Bool("noenv", false, "disable environment variable lookups")
+	profile := fs.String("profile", "", "select the profile used by %profile values")
+	fs.Parse(flag.Args()[1:])
+
+	var opts []moon.Option
+	if *noenv {
+		opts = append(opts, moon.LookupEnv(nil))
 	}
+	if *profile != "" {
+		opts = append(opts, moon.Profile(*profile))
+	}
+	return fs, opts
 }
 
 func to() {
-	switch flag.Arg(1) {
+	fs, opts := evalFlags("to")
+	switch fs.Arg(0) {
 	case "json":
-		to_json(2)
+		to_json(fs.Arg(1), opts...)
 	default:
-		fmt.Fprintf(os.Stderr, "%s is not a valid output format\n", flag.Arg(1))
+		fmt.Fprintf(os.Stderr, "%s is not a valid output format\n", fs.Arg(0))
 		fmt.Fprintln(os.Stderr, "valid output formats: json")
 		os.Exit(1)
 	}
 }
 
-func to_json(n int) {
-	in := input(n)
-	defer in.Close()
-	doc, err := moon.Read(in)
+func to_json(path string, opts ...moon.Option) {
+	doc, err := readPath(path, opts...)
 	if err != nil {
 		bail(1, "input error: %s", err)
 	}
@@ -203,11 +263,9 @@ func to_json(n int) {
 }
 
 func get() {
-	docpath := flag.Arg(1)
-	in := input(2)
-	defer in.Close()
-
-	doc, err := moon.Read(in)
+	fs, opts := evalFlags("get")
+	docpath := fs.Arg(0)
+	doc, err := readPath(fs.Arg(1), opts...)
 	if err != nil {
 		bail(1, "input error: %s", err)
 	}
@@ -223,10 +281,8 @@ func get() {
 }
 
 func eval() {
-	in := input(1)
-	defer in.Close()
-
-	doc, err := moon.Read(in)
+	fs, opts := evalFlags("eval")
+	doc, err := readPath(fs.Arg(0), opts...)
 	if err != nil {
 		bail(1, "input error: %s", err)
 	}
@@ -237,6 +293,115 @@ func eval() {
 	os.Stdout.Write(b)
 }
 
+func fmt_() {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "write result to (source) file instead of stdout")
+	list := fs.Bool("l", false, "list files whose formatting differs from moon fmt's")
+	diff := fs.Bool("d", false, "display diffs instead of rewriting files")
+	fs.Parse(flag.Args()[1:])
+
+	if fs.NArg() == 0 {
+		if *write {
+			bail(1, "cannot use -w with standard input")
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			bail(1, "input error: %s", err)
+		}
+		if err := formatFile("<standard input>", src, *list, *diff, false); err != nil {
+			bail(1, "%s", err)
+		}
+		return
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		src, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = formatFile(path, src, *list, *diff, *write)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+// formatFile formats the moon document src read from path. If none of list,
+// diff or write is set, the formatted document is printed on stdout.
+func formatFile(path string, src []byte, list, diff, write bool) error {
+	out, err := moon.Format(src)
+	if err != nil {
+		if e, ok := err.(*moon.SyntaxError); ok && e.Pos.Filename == "" {
+			e.Pos.Filename = path
+		}
+		return err
+	}
+	if !list && !diff && !write {
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+	if bytes.Equal(src, out) {
+		return nil
+	}
+	if list {
+		fmt.Println(path)
+	}
+	if write {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, out, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if diff {
+		d, err := unifiedDiff(path, src, out)
+		if err != nil {
+			return fmt.Errorf("computing diff: %s", err)
+		}
+		os.Stdout.Write(d)
+	}
+	return nil
+}
+
+// unifiedDiff compares two versions of a file using the system's diff
+// utility, as gofmt does.
+func unifiedDiff(path string, a, b []byte) ([]byte, error) {
+	fa, err := writeTemp(a)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fa)
+	fb, err := writeTemp(b)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fb)
+
+	out, err := exec.Command("diff", "-u", "--label", path+".orig", "--label", path, fa, fb).Output()
+	if len(out) > 0 {
+		// diff exits with a status of 1 when the files differ
+		return out, nil
+	}
+	return nil, err
+}
+
+func writeTemp(b []byte) (string, error) {
+	f, err := ioutil.TempFile("", "moonfmt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
 func bail(status int, t string, args ...interface{}) {
 	var w io.Writer
 	if status == 0 {
@@ -259,8 +424,10 @@ func main() {
 		get()
 	case "eval":
 		eval()
+	case "fmt":
+		fmt_()
 	case "":
-		bail(1, "must specify an action.\nvalid actions: check to get eval")
+		bail(1, "must specify an action.\nvalid actions: check to get eval fmt")
 	default:
 		bail(1, "no such action:%s", flag.Arg(0))
 	}
@@ -0,0 +1,292 @@
+package moon
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Unmarshaler is the interface implemented by types that can decode a Moon
+// representation of themselves. The data given to UnmarshalMoon is the Moon
+// encoding of the value found in the document: for an object, that's a
+// document with one item per line, which may itself be read with Unmarshal or
+// Read. Unmarshaler is the counterpart of Marshaler.
+type Unmarshaler interface {
+	UnmarshalMoon([]byte) error
+}
+
+var (
+	unmarshalerType       = reflect.TypeOf(new(Unmarshaler)).Elem()
+	textUnmarshalerType   = reflect.TypeOf(new(encoding.TextUnmarshaler)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf(new(encoding.BinaryUnmarshaler)).Elem()
+)
+
+// Unmarshal parses Moon-encoded data and stores the result in the value
+// pointed to by v, which must be a non-nil pointer. The data may be either a
+// complete document or a single value, such as a list or a number, so that
+// anything produced by Marshal can be read back in.
+//
+// Unmarshal decodes into Go values as follows:
+//
+//   - an object (or a document) fills a struct in the same way as Fill, or a
+//     map with string keys, one entry per item
+//   - a list fills a slice, one element per item
+//   - into an empty interface, objects are stored as map[string]interface{}
+//     and lists as []interface{}
+//   - a destination that implements Unmarshaler decodes the value itself
+//   - a string fills a destination that implements encoding.TextUnmarshaler
+//     (or, failing that, encoding.BinaryUnmarshaler) by way of that method,
+//     so that types such as net.IP and *url.URL may be written as strings
+//   - a number fills any numeric type that can hold it. An integer fills a
+//     float or complex field only if it can be represented exactly, and a
+//     float with no fractional part fills an integer field. Values that would
+//     overflow are reported as errors. A float that fills a float32 or
+//     complex64 field is rounded to the nearest value of that type, as in a
+//     Go conversion, so only its range is checked.
+//   - pointers are allocated as needed
+//   - all other values are assigned directly
+//
+// Like Fill, Unmarshal reports every value that could not be assigned, not
+// just the first.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("destination is of type %v; a non-nil pointer is required", reflect.TypeOf(v))
+	}
+	src, err := readValue(data)
+	if err != nil {
+		return err
+	}
+	return decodeValue(src, rv.Elem(), "")
+}
+
+// readValue reads either a document or a single value from data.
+func readValue(data []byte) (interface{}, error) {
+	p := newParser(bytes.NewReader(data), "")
+	switch p.peek().t {
+	case t_name, t_variable, t_eof:
+		if err := p.parse(); err != nil {
+			return nil, err
+		}
+		ctx := newContext()
+		if _, err := p.root.eval(ctx); err != nil {
+			return nil, err
+		}
+		return ctx.public, nil
+	}
+
+	n, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.next(); t.t != t_eof {
+		return nil, syntaxErrorf(t.pos, "parse error: unexpected %v token after value", t.t)
+	}
+	return n.eval(newContext())
+}
+
+// decodeValue stores the evaluated Moon value src in the destination value
+// dv. path is the location of src within the document, and is used for error
+// reporting.
+func decodeValue(src interface{}, dv reflect.Value, path string) error {
+	if src == nil {
+		dv.Set(reflect.Zero(dv.Type()))
+		return nil
+	}
+	if ok, err := decodeHook(src, dv, path); ok {
+		return err
+	}
+	if ok, err := decodeNumber(src, dv, path); ok {
+		return err
+	}
+	st := reflect.TypeOf(src)
+
+	switch {
+	case st == dv.Type():
+		dv.Set(reflect.ValueOf(src))
+		return nil
+	case dv.Kind() == reflect.Interface && dv.NumMethod() == 0:
+		dv.Set(reflect.ValueOf(plain(src)))
+		return nil
+	case dv.Kind() == reflect.Ptr && !st.AssignableTo(dv.Type()):
+		if dv.IsNil() {
+			dv.Set(reflect.New(dv.Type().Elem()))
+		}
+		return decodeValue(src, dv.Elem(), path)
+	}
+
+	switch sv := src.(type) {
+	case *Object:
+		return sv.fillValue(dv, path)
+	case List:
+		return sv.fillValue(dv, path)
+	}
+
+	if !st.AssignableTo(dv.Type()) {
+		return &TypeError{Path: path, Expected: dv.Type(), Actual: st}
+	}
+	dv.Set(reflect.ValueOf(src))
+	return nil
+}
+
+// decodeHook decodes src into dv using dv's own decoding methods, if it has
+// any. It reports whether such a method was used, along with any error it
+// returned.
+func decodeHook(src interface{}, dv reflect.Value, path string) (bool, error) {
+	if !dv.CanSet() {
+		return false, nil
+	}
+	pv := dv
+	if dv.Kind() != reflect.Ptr {
+		pv = dv.Addr()
+	}
+	pt := pv.Type()
+
+	var call func() error
+	switch s, isString := src.(string); {
+	case pt.Implements(unmarshalerType):
+		b, err := Encode(src)
+		if err != nil {
+			return true, &TypeError{Path: path, Expected: dv.Type(), Actual: reflect.TypeOf(src), Err: err}
+		}
+		call = func() error { return pv.Interface().(Unmarshaler).UnmarshalMoon(b) }
+	case isString && pt.Implements(textUnmarshalerType):
+		call = func() error { return pv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)) }
+	case isString && pt.Implements(binaryUnmarshalerType):
+		call = func() error { return pv.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary([]byte(s)) }
+	default:
+		return false, nil
+	}
+
+	if pv.IsNil() {
+		pv.Set(reflect.New(pt.Elem()))
+	}
+	if err := call(); err != nil {
+		return true, &TypeError{Path: path, Expected: dv.Type(), Actual: reflect.TypeOf(src), Err: err}
+	}
+	return true, nil
+}
+
+// decodeNumber converts the number src to the numeric type of dv. It reports
+// whether src and dv are both numeric, along with any error encountered in
+// converting the number, such as the number overflowing the destination
+// type or an integer being too large to represent exactly as a float.
+// Durations are not numbers for this purpose: assigning the integer 30 to
+// a time.Duration is almost certainly a mistake.
+func decodeNumber(src interface{}, dv reflect.Value, path string) (bool, error) {
+	if dv.Type() == durationType {
+		return false, nil
+	}
+	fail := func(format string, args ...interface{}) (bool, error) {
+		return true, &TypeError{
+			Path:     path,
+			Expected: dv.Type(),
+			Actual:   reflect.TypeOf(src),
+			Err:      fmt.Errorf(format, args...),
+		}
+	}
+
+	var (
+		i       int64
+		f       float64
+		c       complex128
+		integer bool // whether the source is an integer, or a float with no fractional part
+		isReal  bool // whether the source has no imaginary part
+	)
+	switch n := src.(type) {
+	case int:
+		i, f, c = int64(n), float64(n), complex(float64(n), 0)
+		integer, isReal = true, true
+	case float64:
+		f, c = n, complex(n, 0)
+		isReal = true
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			i, integer = int64(n), true
+		}
+	case complex128:
+		c = n
+		if imag(n) == 0 {
+			f, isReal = real(n), true
+		}
+	default:
+		return false, nil
+	}
+
+	switch dv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !integer {
+			return fail("%v is not an integer", src)
+		}
+		if dv.OverflowInt(i) {
+			return fail("%v overflows %v", src, dv.Type())
+		}
+		dv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if !integer {
+			return fail("%v is not an integer", src)
+		}
+		if i < 0 {
+			return fail("%v underflows %v", src, dv.Type())
+		}
+		if dv.OverflowUint(uint64(i)) {
+			return fail("%v overflows %v", src, dv.Type())
+		}
+		dv.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		if !isReal {
+			return fail("%v is not a real number", src)
+		}
+		if dv.OverflowFloat(f) {
+			return fail("%v overflows %v", src, dv.Type())
+		}
+		if _, ok := src.(int); ok && !exactFloat(i, dv.Kind() == reflect.Float32) {
+			return fail("%v can't be represented exactly by %v", src, dv.Type())
+		}
+		dv.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		if dv.OverflowComplex(c) {
+			return fail("%v overflows %v", src, dv.Type())
+		}
+		if _, ok := src.(int); ok && !exactFloat(i, dv.Kind() == reflect.Complex64) {
+			return fail("%v can't be represented exactly by %v", src, dv.Type())
+		}
+		dv.SetComplex(c)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// exactFloat determines whether the integer i survives a conversion to a
+// float64, or to a float32 if single is set.
+func exactFloat(i int64, single bool) bool {
+	f := float64(i)
+	if single {
+		f = float64(float32(f))
+	}
+	return f >= math.MinInt64 && f < math.MaxInt64 && int64(f) == i
+}
+
+// plain converts objects and lists into the map and slice types used by
+// encoding/json, so that values decoded into an empty interface don't expose
+// moon's own types.
+func plain(v interface{}) interface{} {
+	switch t := v.(type) {
+	case *Object:
+		m := make(map[string]interface{}, len(t.items))
+		for k, item := range t.items {
+			m[k] = plain(item)
+		}
+		return m
+	case List:
+		s := make([]interface{}, len(t))
+		for i, item := range t {
+			s[i] = plain(item)
+		}
+		return s
+	default:
+		return v
+	}
+}
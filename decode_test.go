@@ -0,0 +1,441 @@
+package moon
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type marshalServer struct {
+	Host string `name: host`
+	Port int    `name: port`
+}
+
+type marshalConfig struct {
+	Name     string `name: name`
+	Ratio    float64
+	Enabled  bool `name: enabled`
+	Timeout  time.Duration
+	Tags     []string `name: tags`
+	Primary  marshalServer
+	Backup   *marshalServer `name: backup`
+	Replicas []marshalServer
+	Limits   map[string]int `name: limits`
+	Extra    interface{}
+	hidden   string
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	in := marshalConfig{
+		Name:     `the "main" config`,
+		Ratio:    1,
+		Enabled:  true,
+		Timeout:  90 * time.Second,
+		Tags:     []string{"one", "two"},
+		Primary:  marshalServer{"db.example.com", 5432},
+		Backup:   &marshalServer{"backup.example.com", 5433},
+		Replicas: []marshalServer{{"r1", 1}, {"r2", 2}},
+		Limits:   map[string]int{"b": 2, "a": 1},
+		Extra:    []interface{}{1, "two", map[string]interface{}{"three": 3.0}},
+		hidden:   "not written",
+	}
+
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `name: "the \"main\" config"
+Ratio: 1.0
+enabled: true
+Timeout: 1m30s
+tags: ["one" "two"]
+Primary: {host: "db.example.com" port: 5432}
+backup: {host: "backup.example.com" port: 5433}
+Replicas: [{host: "r1" port: 1} {host: "r2" port: 2}]
+limits: {a: 1 b: 2}
+Extra: [1 "two" {three: 3.0}]
+`
+	if string(b) != expected {
+		t.Errorf("expected\n%s\nsaw\n%s", expected, b)
+	}
+
+	var out marshalConfig
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.hidden = ""
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip failed:\n%#v\n%#v", in, out)
+	}
+
+	// a document produced by Marshal is also an ordinary document
+	doc, err := ReadBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var port int
+	if err := doc.Get("backup/port", &port); err != nil || port != 5433 {
+		t.Errorf("expected backup/port to be 5433, saw %d (%v)", port, err)
+	}
+}
+
+func TestMarshalRoundTripNumbers(t *testing.T) {
+	type numbers struct {
+		Port  uint16     `name: port`
+		Size  uint64     `name: size`
+		Small uint8      `name: small`
+		Addr  uintptr    `name: addr`
+		Wave  complex64  `name: wave`
+		Phase complex128 `name: phase`
+		Flip  complex128 `name: flip`
+	}
+	in := numbers{80, 1 << 40, 255, 4096, 1 - 2i, -1.5 - 0.25i, -3 + 4i}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "port: 80\nsize: 1099511627776\nsmall: 255\naddr: 4096\nwave: 1-2i\nphase: -1.5-0.25i\nflip: -3+4i\n"
+	if string(b) != expected {
+		t.Errorf("expected\n%s\nsaw\n%s", expected, b)
+	}
+	var out numbers
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("round trip failed:\n%#v\n%#v", in, out)
+	}
+}
+
+func TestMarshalKeys(t *testing.T) {
+	in := map[string]int{"x:y": 1, "a;b": 2, "c#d": 3, `back\slash`: 4, "e[0]": 5}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]int
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatalf("unable to read back %s: %s", b, err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip failed:\n%v\n%v", in, out)
+	}
+
+	// a null name in a tag leaves the field's own name in place
+	type nullName struct {
+		N int `name: null; long: null`
+	}
+	if b, err := Marshal(nullName{3}); err != nil || string(b) != "N: 3\n" {
+		t.Errorf("expected a null name to fall back to the field name, saw %q (%v)", b, err)
+	}
+	var nn nullName
+	if err := Unmarshal([]byte("N: 3"), &nn); err != nil || nn.N != 3 {
+		t.Errorf("expected a null name to fall back to the field name, saw %+v (%v)", nn, err)
+	}
+
+	for _, key := range []string{"", "a b", "8080", "@hidden", "\"quoted\"", "tab\t", "[e]"} {
+		if b, err := Marshal(map[string]int{key: 1}); err == nil {
+			t.Errorf("%q: expected an error, saw %s", key, b)
+		}
+	}
+}
+
+func TestMarshalUnsupportedValues(t *testing.T) {
+	tests := []struct {
+		in  interface{}
+		msg string
+	}{
+		{struct{ F float64 }{math.Inf(1)}, "unsupported value: +Inf"},
+		{[]float32{float32(math.NaN())}, "unsupported value: NaN"},
+		{complex(1, math.Inf(-1)), "unsupported value: -Inf"},
+		{uint64(math.MaxUint64), "unsupported value: 18446744073709551615 overflows a Moon integer"},
+		{[]string{"ok", "bad\xff"}, `unsupported value: "bad\xff" is not valid UTF-8`},
+		{map[string]int{"k\xe9": 1}, `unsupported key "k\xe9": a name must be valid UTF-8`},
+	}
+	for _, test := range tests {
+		_, err := Marshal(test.in)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%v: expected error %q, saw %v", test.in, test.msg, err)
+		}
+	}
+}
+
+func TestUnmarshalValues(t *testing.T) {
+	var i int
+	if err := Unmarshal([]byte("12"), &i); err != nil || i != 12 {
+		t.Errorf("expected 12, saw %d (%v)", i, err)
+	}
+
+	var s string
+	if err := Unmarshal([]byte(`"hello"`), &s); err != nil || s != "hello" {
+		t.Errorf("expected hello, saw %q (%v)", s, err)
+	}
+
+	var l []int
+	if err := Unmarshal([]byte("[1 2 3] # numbers"), &l); err != nil || !reflect.DeepEqual(l, []int{1, 2, 3}) {
+		t.Errorf("expected [1 2 3], saw %v (%v)", l, err)
+	}
+
+	var m map[string]interface{}
+	if err := Unmarshal([]byte("a: 1\nb: [x; {c: true}]\n@v: 1\n"), &m); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a": 1,
+		"b": []interface{}{"x", map[string]interface{}{"c": true}},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v, saw %v", expected, m)
+	}
+
+	var v interface{}
+	if err := Unmarshal([]byte("{a: 1}"), &v); err != nil || !reflect.DeepEqual(v, map[string]interface{}{"a": 1}) {
+		t.Errorf("expected map[a:1], saw %v (%v)", v, err)
+	}
+
+	var o *Object
+	if err := Unmarshal([]byte("a: 1\nb: 2"), &o); err != nil || !reflect.DeepEqual(o.Keys(), []string{"a", "b"}) {
+		t.Errorf("expected an object with keys a and b, saw %v (%v)", o, err)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var i int
+	if err := Unmarshal([]byte("1"), i); err == nil {
+		t.Error("expected an error unmarshaling into a non-pointer")
+	}
+	if err := Unmarshal([]byte("1"), nil); err == nil {
+		t.Error("expected an error unmarshaling into nil")
+	}
+	if err := Unmarshal([]byte("1 2"), &i); err == nil {
+		t.Error("expected an error for trailing values")
+	}
+
+	var s marshalServer
+	err := Unmarshal([]byte("host: 1\nport: x\n"), &s)
+	diags, ok := err.(Diagnostics)
+	if !ok || len(diags) != 2 {
+		t.Fatalf("expected two errors, saw %v", err)
+	}
+	if te, ok := diags[1].(*TypeError); !ok || te.Path != "port" || te.Pos.Line != 2 {
+		t.Errorf("expected a type error for port on line 2, saw %v", diags[1])
+	}
+}
+
+type logLevel int
+
+func (l *logLevel) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "debug":
+		*l = 1
+	case "info":
+		*l = 2
+	default:
+		return fmt.Errorf("unknown log level %q", b)
+	}
+	return nil
+}
+
+// endpoint decodes either a "host:port" string or an object with host and
+// port fields.
+type endpoint struct {
+	addr string
+}
+
+func (e *endpoint) UnmarshalMoon(b []byte) error {
+	var s string
+	if err := Unmarshal(b, &s); err == nil {
+		e.addr = s
+		return nil
+	}
+	var hp marshalServer
+	if err := Unmarshal(b, &hp); err != nil {
+		return err
+	}
+	e.addr = fmt.Sprintf("%s:%d", hp.Host, hp.Port)
+	return nil
+}
+
+func TestUnmarshalHooks(t *testing.T) {
+	var config struct {
+		Level   logLevel    `name: level`
+		Levels  []logLevel  `name: levels`
+		Addr    net.IP      `name: addr`
+		URL     *url.URL    `name: url`
+		Big     *big.Int    `name: big`
+		Primary endpoint    `name: primary`
+		Backup  *endpoint   `name: backup`
+		Extra   []*endpoint `name: extra`
+	}
+	doc, err := ReadString(`
+		level: debug
+		levels: [info; debug]
+		addr: "10.0.0.1"
+		url: "https://example.com/path?q=1"
+		big: "123456789012345678901234567890"
+		primary: {host: db.example.com; port: 5432}
+		backup: "backup.example.com:5433"
+		extra: ["a:1" {host: b; port: 2}]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.Fill(&config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Level != 1 || !reflect.DeepEqual(config.Levels, []logLevel{2, 1}) {
+		t.Errorf("bad log levels: %v %v", config.Level, config.Levels)
+	}
+	if !config.Addr.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("bad ip address: %v", config.Addr)
+	}
+	if config.URL == nil || config.URL.Host != "example.com" || config.URL.RawQuery != "q=1" {
+		t.Errorf("bad url: %v", config.URL)
+	}
+	if config.Big == nil || config.Big.String() != "123456789012345678901234567890" {
+		t.Errorf("bad big int: %v", config.Big)
+	}
+	if config.Primary.addr != "db.example.com:5432" {
+		t.Errorf("bad primary endpoint: %v", config.Primary.addr)
+	}
+	if config.Backup == nil || config.Backup.addr != "backup.example.com:5433" {
+		t.Errorf("bad backup endpoint: %v", config.Backup)
+	}
+	if len(config.Extra) != 2 || config.Extra[0].addr != "a:1" || config.Extra[1].addr != "b:2" {
+		t.Errorf("bad extra endpoints: %v", config.Extra)
+	}
+
+	var ip net.IP
+	if err := doc.Get("addr", &ip); err != nil || ip.String() != "10.0.0.1" {
+		t.Errorf("bad ip address from Get: %v (%v)", ip, err)
+	}
+
+	doc, err = ReadString("level: loud\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doc.Fill(&config)
+	var te *TypeError
+	if !errors.As(err, &te) || te.Path != "level" || te.Pos.Line != 1 {
+		t.Fatalf("expected a type error for level on line 1, saw %v", err)
+	}
+	if !strings.Contains(err.Error(), `unknown log level "loud"`) {
+		t.Errorf("expected the error from UnmarshalText, saw %v", err)
+	}
+}
+
+func TestNumericConversion(t *testing.T) {
+	var config struct {
+		Port    uint16             `name: port`
+		Ratio   float64            `name: ratio`
+		Small   int8               `name: small`
+		Count   int64              `name: count`
+		Scale   float32            `name: scale`
+		Tenth   float32            `name: tenth`
+		Whole   int                `name: whole`
+		Wave    complex64          `name: wave`
+		Bytes   []uint8            `name: bytes`
+		Weights map[string]float64 `name: weights`
+		Retries uint               `name: retries; default: 3`
+	}
+	doc, err := ReadString(`
+		port: 8080
+		ratio: 1
+		small: -128
+		count: 9000000000
+		scale: 2.5
+		tenth: 0.1
+		whole: 4.0
+		wave: 1+2i
+		bytes: [0 255]
+		weights: {a: 1; b: 0.5}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.Fill(&config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != 8080 || config.Ratio != 1 || config.Small != -128 || config.Count != 9000000000 {
+		t.Errorf("bad integer conversion: %+v", config)
+	}
+	// a float is rounded to fit a float32, as in a Go conversion
+	if config.Scale != 2.5 || config.Tenth != 0.1 || config.Whole != 4 || config.Wave != 1+2i || config.Retries != 3 {
+		t.Errorf("bad conversion: %+v", config)
+	}
+	if !reflect.DeepEqual(config.Bytes, []uint8{0, 255}) {
+		t.Errorf("bad list conversion: %v", config.Bytes)
+	}
+	if !reflect.DeepEqual(config.Weights, map[string]float64{"a": 1, "b": 0.5}) {
+		t.Errorf("bad map conversion: %v", config.Weights)
+	}
+
+	var port int32
+	if err := doc.Get("port", &port); err != nil || port != 8080 {
+		t.Errorf("expected to get port 8080, saw %d (%v)", port, err)
+	}
+	var small uint8
+	if err := doc.Get("small", &small); err == nil {
+		t.Errorf("expected an error getting -128 as a uint8, saw %d", small)
+	}
+}
+
+func TestNumericConversionErrors(t *testing.T) {
+	var config struct {
+		Port    uint16        `name: port`
+		Retries uint          `name: retries`
+		Whole   int           `name: whole`
+		Bytes   []byte        `name: bytes`
+		Scale   float32       `name: scale`
+		Ratio   float64       `name: ratio`
+		Timeout time.Duration `name: timeout`
+		Big     float64       `name: big`
+		Odd     complex64     `name: odd`
+	}
+	doc, err := ReadString(`
+		port: 70000
+		retries: -1
+		whole: 1.5
+		bytes: [1 300]
+		scale: 1e300
+		ratio: 1+2i
+		timeout: 30
+		big: 9007199254740993
+		odd: 16777217
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doc.Fill(&config)
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("expected diagnostics, saw %v", err)
+	}
+	expected := []string{
+		"2:9: unable to assign port: 70000 overflows uint16",
+		"3:12: unable to assign retries: -1 underflows uint",
+		"4:10: unable to assign whole: 1.5 is not an integer",
+		"5:10: unable to assign bytes/1: 300 overflows uint8",
+		"6:10: unable to assign scale: 1e+300 overflows float32",
+		"7:10: unable to assign ratio: (1+2i) is not a real number",
+		"8:12: unable to assign timeout: source type int is not assignable to destination type time.Duration",
+		"9:8: unable to assign big: 9007199254740993 can't be represented exactly by float64",
+		"10:8: unable to assign odd: 16777217 can't be represented exactly by complex64",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d errors, saw %d:\n%v", len(expected), len(diags), err)
+	}
+	for i, err := range diags {
+		if err.Error() != expected[i] {
+			t.Errorf("expected %q, saw %q", expected[i], err.Error())
+		}
+	}
+}
@@ -6,14 +6,43 @@ import (
 	"math"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Marshaler is the interface implemented by types that can encode themselves
+// as Moon values.
 type Marshaler interface {
 	MarshalMoon() ([]byte, error)
 }
 
+// Marshal returns the Moon document encoding of v, the inverse of Unmarshal.
+// Structs, maps with string keys and Objects are encoded as documents, with
+// one item per line, so that the output can also be read with Read; any other
+// value is encoded as it would be by Encode. Struct fields are named
+// according to the same name tag that Fill uses, and unexported fields are
+// skipped.
+func Marshal(v interface{}) ([]byte, error) {
+	e := &encoder{}
+	if err := e.try(func() { e.encodeDocument(reflect.ValueOf(v)) }); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+// Encode returns the Moon encoding of v. An *Object is encoded as a document,
+// with one item per line; objects, structs and maps found within other values
+// are encoded in braces. Struct fields are written in the order they are
+// declared, Object items in the order they were defined, and map entries in
+// order of their keys.
 func Encode(v interface{}) ([]byte, error) {
+	if o, ok := v.(*Object); ok && o != nil {
+		return o.MarshalMoon()
+	}
 	e := &encoder{}
 	if err := e.encode(v); err != nil {
 		return nil, err
@@ -26,7 +55,13 @@ type encoder struct {
 	scratch [64]byte
 }
 
-func (e *encoder) encode(v interface{}) (err error) {
+func (e *encoder) encode(v interface{}) error {
+	return e.try(func() { e.encodeValue(reflect.ValueOf(v)) })
+}
+
+// try runs an encoding function, turning the errors that it panics with back
+// into errors.
+func (e *encoder) try(fn func()) (err error) {
 	defer func() {
 		r := recover()
 		if r == nil {
@@ -40,10 +75,134 @@ func (e *encoder) encode(v interface{}) (err error) {
 		}
 		err = r.(error)
 	}()
-	e.encodeValue(reflect.ValueOf(v))
+	fn()
 	return nil
 }
 
+// encodeDocument writes a struct, map or object as a sequence of
+// assignments, one per line. Other values are written as they are.
+func (e *encoder) encodeDocument(v reflect.Value) {
+	if !v.IsValid() {
+		encodeNull(e, v)
+		return
+	}
+	t := v.Type()
+	switch {
+	case t == objectType && !v.IsNil():
+		e.encodeEntries(objectEntries(v.Interface().(*Object)), true)
+	case t.Implements(marshalerType):
+		marshalerEncoder(e, v)
+	case t.Kind() == reflect.Ptr, t.Kind() == reflect.Interface:
+		if v.IsNil() {
+			encodeNull(e, v)
+			return
+		}
+		e.encodeDocument(v.Elem())
+	case t.Kind() == reflect.Struct:
+		e.encodeEntries(structEntries(v), true)
+	case t.Kind() == reflect.Map:
+		e.encodeEntries(mapEntries(v), true)
+	default:
+		e.encodeValue(v)
+	}
+}
+
+// encodeKey writes the name of an entry, escaping the characters that would
+// otherwise end it. A name has to begin with a letter, an underscore or some
+// other printable character that doesn't begin a different kind of token, and
+// can't contain spaces; other names can't be written, and are an error.
+func (e *encoder) encodeKey(key string) {
+	if !utf8.ValidString(key) {
+		panic(fmt.Errorf("unsupported key %q: a name must be valid UTF-8", key))
+	}
+	for i, r := range key {
+		switch {
+		case i == 0 && !unicode.IsLetter(r) && r != '_' && (r < utf8.RuneSelf || !unicode.IsGraphic(r)):
+			panic(fmt.Errorf("unsupported key %q: a name must begin with a letter or an underscore", key))
+		case unicode.IsSpace(r) || !unicode.IsPrint(r):
+			panic(fmt.Errorf("unsupported key %q: a name can't contain spaces or unprintable characters", key))
+		case isSpecial(r), r == '\\':
+			e.WriteByte('\\')
+		}
+		e.WriteRune(r)
+	}
+	if key == "" {
+		panic(fmt.Errorf("unsupported key: a name can't be empty"))
+	}
+}
+
+// entry is a named value within a struct, map or object.
+type entry struct {
+	key   string
+	value reflect.Value
+}
+
+// encodeEntries writes named values either as a document, one assignment per
+// line, or as an object in braces.
+func (e *encoder) encodeEntries(entries []entry, doc bool) {
+	if !doc {
+		e.WriteByte('{')
+	}
+	for i, ent := range entries {
+		if i > 0 && !doc {
+			e.separate(entries[i-1].value)
+		}
+		e.encodeKey(ent.key)
+		e.WriteByte(':')
+		e.WriteByte(' ')
+		e.encodeValue(ent.value)
+		if doc {
+			e.WriteByte('\n')
+		}
+	}
+	if !doc {
+		e.WriteByte('}')
+	}
+}
+
+// structEntries gives the exported fields of a struct, in the order they are
+// declared, using the names they'd be given by Fill.
+func structEntries(v reflect.Value) []entry {
+	t := v.Type()
+	reqs, err := requirements(t)
+	if err != nil {
+		panic(err)
+	}
+	entries := make([]entry, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		entries = append(entries, entry{reqs[f.Name].name, v.Field(i)})
+	}
+	return entries
+}
+
+// mapEntries gives the entries of a map in order of their keys.
+func mapEntries(v reflect.Value) []entry {
+	t := v.Type()
+	if t.Key().Kind() != reflect.String {
+		panic(fmt.Errorf("unsupported map key type: %v", t.Key().Kind()))
+	}
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	entries := make([]entry, len(keys))
+	for i, key := range keys {
+		entries[i] = entry{key.String(), v.MapIndex(key)}
+	}
+	return entries
+}
+
+// objectEntries gives the items of an object in the order they were defined.
+func objectEntries(o *Object) []entry {
+	entries := make([]entry, len(o.keys))
+	for i, k := range o.keys {
+		entries[i] = entry{k, reflect.ValueOf(o.items[k])}
+	}
+	return entries
+}
+
 func (e *encoder) encodeValue(v reflect.Value) {
 	fn := valueEncoder(v)
 	fn(e, v)
@@ -58,9 +217,20 @@ func valueEncoder(v reflect.Value) encodeFn {
 
 var (
 	marshalerType = reflect.TypeOf(new(Marshaler)).Elem()
+	objectType    = reflect.TypeOf(new(Object))
+	durationType  = reflect.TypeOf(time.Duration(0))
+	timeType      = reflect.TypeOf(time.Time{})
 )
 
 func typeEncoder(t reflect.Type) encodeFn {
+	switch t {
+	case objectType:
+		return encodeObject
+	case durationType:
+		return encodeDuration
+	case timeType:
+		return encodeTime
+	}
 	if t.Implements(marshalerType) {
 		return marshalerEncoder
 	}
@@ -70,10 +240,14 @@ func typeEncoder(t reflect.Type) encodeFn {
 		return encodeBool
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return encodeInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return encodeUint
 	case reflect.Float32:
 		return encodeFloat32
 	case reflect.Float64:
 		return encodeFloat64
+	case reflect.Complex64:
+		return encodeComplex64
 	case reflect.Complex128:
 		return encodeComplex128
 	case reflect.String:
@@ -108,6 +282,17 @@ func encodeInt(e *encoder, v reflect.Value) {
 	e.Write(b)
 }
 
+// encodeUint writes an unsigned integer. Moon integers are signed, so
+// integers too large for an int64 can't be read back, and aren't written.
+func encodeUint(e *encoder, v reflect.Value) {
+	u := v.Uint()
+	if u > math.MaxInt64 {
+		panic(fmt.Errorf("unsupported value: %d overflows a Moon integer", u))
+	}
+	b := strconv.AppendUint(e.scratch[:0], u, 10)
+	e.Write(b)
+}
+
 func encodeNull(e *encoder, v reflect.Value) {
 	e.WriteString("null")
 }
@@ -115,29 +300,26 @@ func encodeNull(e *encoder, v reflect.Value) {
 func encodeFloat(bits int) encodeFn {
 	return func(e *encoder, v reflect.Value) {
 		f := v.Float()
-		if math.IsInf(f, 0) || math.IsNaN(f) {
-			panic("that value is bad") // TODO: not this
-		}
+		checkFloat(f)
 		b := strconv.AppendFloat(e.scratch[:0], f, 'g', -1, bits)
+		if bytes.IndexAny(b, ".e") < 0 {
+			// whole numbers need a decimal point to be read back as floats
+			b = append(b, '.', '0')
+		}
 		e.Write(b)
 	}
 }
 
-func encodeStruct(e *encoder, v reflect.Value) {
-	t := v.Type()
-	e.WriteByte('{')
-	for i := 0; i < t.NumField(); i++ {
-		f := t.Field(i)
-		e.WriteString(f.Name)
-		e.WriteByte(':')
-		e.WriteByte(' ')
-		fv := v.FieldByName(f.Name)
-		e.encodeValue(fv)
-		if i != t.NumField()-1 {
-			e.WriteByte(' ')
-		}
+// checkFloat rejects the floats that Moon has no way to write: infinities
+// and NaN.
+func checkFloat(f float64) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		panic(fmt.Errorf("unsupported value: %v", f))
 	}
-	e.WriteByte('}')
+}
+
+func encodeStruct(e *encoder, v reflect.Value) {
+	e.encodeEntries(structEntries(v), false)
 }
 
 var (
@@ -145,31 +327,86 @@ var (
 	encodeFloat64 = encodeFloat(64)
 )
 
-// this is a really over-simplified string emitter.  I highly doubt it can stay
-// like this.
 func encodeString(e *encoder, v reflect.Value) {
-	s := v.String()
-	e.WriteByte('"')
+	if !utf8.ValidString(v.String()) {
+		panic(fmt.Errorf("unsupported value: %q is not valid UTF-8", v.String()))
+	}
+	// a literal @{ is doubled, so that it isn't read back as a reference
+	s := strings.Replace(v.String(), "@{", "@@{", -1)
+	writeQuoted(&e.Buffer, s)
+}
+
+// writeQuoted writes s as a double-quoted string. Quotes, backslashes and
+// characters that aren't printable are written as escape sequences, so that
+// the string reads back exactly as it was. s must be valid UTF-8, since the
+// lexer reads every string as UTF-8 and has no escape for a single byte.
+func writeQuoted(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
 	for _, r := range s {
 		switch r {
-		case '\\':
-			e.WriteByte('\\')
-			e.WriteByte('\\')
-		case '"':
-			e.WriteByte('\\')
-			e.WriteByte('"')
+		case '\\', '"':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
 		default:
-			e.WriteRune(r)
+			switch {
+			case unicode.IsPrint(r) || r == ' ':
+				buf.WriteRune(r)
+			case r < 0x80:
+				fmt.Fprintf(buf, `\x%02x`, r)
+			case r <= 0xffff:
+				fmt.Fprintf(buf, `\u%04x`, r)
+			default:
+				fmt.Fprintf(buf, `\U%08x`, r)
+			}
 		}
 	}
-	e.WriteByte('"')
+	buf.WriteByte('"')
+}
+
+// separate writes the separator between the value prev and the value that
+// follows it on the same line. The bare words true, false and null would run
+// on into whatever follows them, so they're terminated explicitly.
+func (e *encoder) separate(prev reflect.Value) {
+	if isWord(prev) {
+		e.WriteString("; ")
+	} else {
+		e.WriteByte(' ')
+	}
+}
+
+// isWord determines whether v is encoded as one of the bare words true, false
+// or null.
+func isWord(v reflect.Value) bool {
+	for v.IsValid() {
+		if v.Type().Implements(marshalerType) {
+			return v.Kind() == reflect.Ptr && v.IsNil()
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			return true
+		case reflect.Ptr, reflect.Interface:
+			if v.IsNil() {
+				return true
+			}
+			v = v.Elem()
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 func encodeSlice(e *encoder, v reflect.Value) {
 	e.WriteByte('[')
 	for i := 0; i < v.Len(); i++ {
 		if i > 0 {
-			e.WriteByte(' ')
+			e.separate(v.Index(i - 1))
 		}
 		e.encodeValue(v.Index(i))
 	}
@@ -185,23 +422,25 @@ func encodeInterface(e *encoder, v reflect.Value) {
 }
 
 func encodeMap(e *encoder, v reflect.Value) {
-	t := v.Type()
-	if t.Key().Kind() != reflect.String {
-		panic(fmt.Errorf("unsupported map key type: %v", t.Key().Kind()))
-	}
-	keys := v.MapKeys()
-	e.WriteByte('{')
-	for i, key := range keys {
-		if i > 0 {
-			e.WriteByte(' ')
-		}
-		e.WriteString(key.String()) // TODO: escape this?
-		e.WriteByte(':')
-		e.WriteByte(' ')
-		elem := v.MapIndex(key)
-		e.encodeValue(elem)
+	e.encodeEntries(mapEntries(v), false)
+}
+
+func encodeObject(e *encoder, v reflect.Value) {
+	if v.IsNil() {
+		e.WriteString("null")
+		return
 	}
-	e.WriteByte('}')
+	e.encodeEntries(objectEntries(v.Interface().(*Object)), false)
+}
+
+func encodeDuration(e *encoder, v reflect.Value) {
+	e.WriteString(time.Duration(v.Int()).String())
+}
+
+// encodeTime writes a time as an RFC 3339 timestamp, or as a date if it's
+// midnight UTC.
+func encodeTime(e *encoder, v reflect.Value) {
+	e.WriteString(formatTime(v.Interface().(time.Time)))
 }
 
 func encodePointer(e *encoder, v reflect.Value) {
@@ -225,8 +464,23 @@ func marshalerEncoder(e *encoder, v reflect.Value) {
 	e.Write(b)
 }
 
-func encodeComplex128(e *encoder, v reflect.Value) {
-	c := v.Complex()
-	r, i := real(c), imag(c)
-	fmt.Fprintf(e, "%v+%vi", r, i)
+func encodeComplex(bits int) encodeFn {
+	return func(e *encoder, v reflect.Value) {
+		c := v.Complex()
+		r, i := real(c), imag(c)
+		checkFloat(r)
+		checkFloat(i)
+		b := strconv.AppendFloat(e.scratch[:0], r, 'g', -1, bits/2)
+		if !math.Signbit(i) {
+			// the imaginary part is a signed number of its own
+			b = append(b, '+')
+		}
+		b = strconv.AppendFloat(b, i, 'g', -1, bits/2)
+		e.Write(append(b, 'i'))
+	}
 }
+
+var (
+	encodeComplex64  = encodeComplex(64)
+	encodeComplex128 = encodeComplex(128)
+)
@@ -1,7 +1,10 @@
 package moon
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 )
 
 type person struct {
@@ -20,27 +23,36 @@ var valueTests = []struct {
 	{1, "1"},
 	{12345, "12345"},
 	{.1, "0.1"},
-	{1.0, "1"}, // god dammit
+	{1.0, "1.0"},
 	{1.0e9, "1e+09"},
 	{"a string", `"a string"`},
 	{`it's got "quotes"`, `"it's got \"quotes\""`},
+	{"tab\tnewline\nreturn\r", `"tab\tnewline\nreturn\r"`},
+	{"bell\a nul\x00 zwsp\u200b", `"bell\x07 nul\x00 zwsp\u200b"`},
+	{"emoji 😀 é", `"emoji 😀 é"`},
 	{person{"jordan", 28}, `{Name: "jordan" Age: 28}`},
 	{[]int{1, 2, 3}, `[1 2 3]`},
-	{[]float32{1.0, 2.2, 3.3}, `[1 2.2 3.3]`},
-	{[]float64{1.0, 2.2, 3.3}, `[1 2.2 3.3]`},
+	{[]float32{1.0, 2.2, 3.3}, `[1.0 2.2 3.3]`},
+	{[]float64{1.0, 2.2, 3.3}, `[1.0 2.2 3.3]`},
+	{30 * time.Second, `30s`},
+	{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), `2024-05-01`},
+	{time.Date(2024, 5, 1, 9, 30, 0, 500, time.UTC), `2024-05-01T09:30:00.0000005Z`},
+	{time.Date(2024, 5, 1, 0, 0, 0, 0, time.FixedZone("", -7*3600)), `2024-05-01T00:00:00-07:00`},
 	{[]string{"one", "two", "three"}, `["one" "two" "three"]`},
-	// {
-	// 	map[string]int{"one": 1, "two": 2, "three": 3},
-	// 	`{one: 1 two: 2 three: 3}`,
-	// },
-	// {
-	// 	map[string]interface{}{
-	// 		"one": 1,
-	// 		"two": 2.0,
-	// 		"pi":  3.14,
-	// 	},
-	// 	`{one: 1 two: 2 pi: 3.14}`,
-	// },
+	{[]interface{}{true, nil, 1, false}, `[true; null; 1 false]`},
+	{[]*int{nil, nil}, `[null; null]`},
+	{
+		map[string]int{"one": 1, "two": 2, "three": 3},
+		`{one: 1 three: 3 two: 2}`,
+	},
+	{
+		map[string]interface{}{
+			"one": 1,
+			"two": 2.0,
+			"pi":  3.14,
+		},
+		`{one: 1 pi: 3.14 two: 2.0}`,
+	},
 }
 
 func TestWriteValues(t *testing.T) {
@@ -55,3 +67,62 @@ func TestWriteValues(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeKeepsOrder(t *testing.T) {
+	src := "zulu: 1\n@hidden: 2\nalpha: {c: 3 a: [4 {y: 5 x: 6}] b: 7}\nmike: 8\n"
+	doc, err := ReadString(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := doc.Keys(); !reflect.DeepEqual(keys, []string{"zulu", "alpha", "mike"}) {
+		t.Errorf("bad key order: %v", keys)
+	}
+
+	expected := "zulu: 1\nalpha: {c: 3 a: [4 {y: 5 x: 6}] b: 7}\nmike: 8\n"
+	out, err := Encode(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("expected\n%s\nsaw\n%s", expected, out)
+	}
+
+	expected = `{"zulu":1,"alpha":{"c":3,"a":[4,{"y":5,"x":6}],"b":7},"mike":8}`
+	out, err = json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("expected %s, saw %s", expected, out)
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	strs := []string{
+		"",
+		"plain",
+		`back\slash "quoted" 'single'`,
+		"line\nbreak\r\n\ttab",
+		"\x00\x01\x1f\x7f",
+		"\u0080\u00a0\u200b\u2028\ufeff",
+		"\U0001F600 \U000E0001",
+		"literal @{name} and @@{name}",
+	}
+	for _, s := range strs {
+		out, err := Encode(map[string]string{"s": s})
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		doc, err := ReadBytes(append([]byte("v: "), out...))
+		if err != nil {
+			t.Errorf("%q: unable to read %s: %s", s, out, err)
+			continue
+		}
+		var back string
+		if err := doc.Get("v/s", &back); err != nil || back != s {
+			t.Errorf("%q: encoded as %s, read back as %q (%v)", s, out, back, err)
+		}
+	}
+}
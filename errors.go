@@ -0,0 +1,207 @@
+package moon
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SyntaxError is the error returned when a Moon document cannot be lexed or
+// parsed.
+type SyntaxError struct {
+	Pos Position // where in the document the problem was found
+	Msg string   // description of the problem
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+func syntaxErrorf(pos Position, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// EvalError is the error returned when a syntactically valid Moon document
+// cannot be evaluated, e.g., because it references an undefined variable.
+type EvalError struct {
+	Pos  Position // position of the node that failed to evaluate
+	Name string   // name of the variable or key involved, if any
+	Msg  string   // description of the problem
+	Err  error    // underlying cause, if any
+
+	undefined bool // whether the problem is a reference to something that isn't defined
+}
+
+func (e *EvalError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Pos, e.Msg, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+func evalErrorf(pos Position, name string, format string, args ...interface{}) error {
+	return &EvalError{Pos: pos, Name: name, Msg: fmt.Sprintf(format, args...)}
+}
+
+// IncludeError is the error returned when a document included by another
+// can't be read. Err is the error encountered in the included document; when
+// includes are nested, it is itself an *IncludeError, and the message names
+// the whole chain of includes, innermost first.
+type IncludeError struct {
+	Pos  Position // position of the %include directive
+	Path string   // name of the included document
+	Err  error
+}
+
+func (e *IncludeError) Error() string {
+	return fmt.Sprintf("%v\n\tincluded from %s", e.Err, e.Pos)
+}
+
+func (e *IncludeError) Unwrap() error {
+	return e.Err
+}
+
+// TypeError is the error returned when a value in a Moon document cannot be
+// assigned to a Go value of the requested type.
+type TypeError struct {
+	Pos      Position     // position of the offending value, if known
+	Path     string       // path of the offending value within the document
+	Expected reflect.Type // type of the destination
+	Actual   reflect.Type // type of the value found in the document
+	Err      error        // underlying cause, if any
+}
+
+func (e *TypeError) Error() string {
+	var msg string
+	if e.Err != nil {
+		msg = fmt.Sprintf("unable to assign %s: %v", e.Path, e.Err)
+	} else {
+		msg = fmt.Sprintf("unable to assign %s: source type %v is not assignable to destination type %v", e.Path, e.Actual, e.Expected)
+	}
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", e.Pos, msg)
+	}
+	return msg
+}
+
+func (e *TypeError) Unwrap() error {
+	return e.Err
+}
+
+// RequiredFieldError is the error returned by Fill when a field marked as
+// required has no corresponding value in the Moon document, or has a value of
+// null.
+type RequiredFieldError struct {
+	Path  string // path at which the value was expected
+	Field string // name of the struct field to be filled
+	Null  bool   // whether the value was explicitly unset with null
+}
+
+func (e *RequiredFieldError) Error() string {
+	if e.Null {
+		return fmt.Sprintf("required field is null: %s", e.Path)
+	}
+	return fmt.Sprintf("required field missing: %s", e.Path)
+}
+
+// ErrNull is the error returned by Get when the value found is null and the
+// destination has no way to hold a missing value. The destination is still
+// set to its zero value, so a program that treats null like any other zero
+// value can check for ErrNull with errors.Is and carry on.
+var ErrNull = errors.New("value is null")
+
+// Diagnostics is a list of problems found in a Moon document. Diagnostics
+// are produced by Check, which keeps going after the first error, and by Fill,
+// which reports every missing or mistyped field at once.
+type Diagnostics []error
+
+func (d Diagnostics) Error() string {
+	msgs := make([]string, len(d))
+	for i, err := range d {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap gives errors.Is and errors.As access to each individual diagnostic.
+func (d Diagnostics) Unwrap() []error {
+	return d
+}
+
+// Err returns the diagnostics as an error, or nil if there are none.
+func (d Diagnostics) Err() error {
+	if len(d) == 0 {
+		return nil
+	}
+	return d
+}
+
+// sort orders the diagnostics by where they were found in the document.
+// Diagnostics without a position keep their order, after the rest.
+func (d Diagnostics) sort() {
+	sort.SliceStable(d, func(i, j int) bool {
+		a, aok := errorPos(d[i])
+		b, bok := errorPos(d[j])
+		if !aok || !bok {
+			return aok && !bok
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// errorPos gives the position in the document at which err was found, if it
+// has one.
+func errorPos(err error) (Position, bool) {
+	var pos Position
+	switch e := err.(type) {
+	case *SyntaxError:
+		pos = e.Pos
+	case *EvalError:
+		pos = e.Pos
+	case *TypeError:
+		pos = e.Pos
+	case *IncludeError:
+		pos = e.Pos
+	}
+	return pos, pos.IsValid()
+}
+
+// add appends an error to the list of diagnostics, flattening nested lists
+// of diagnostics. Errors that merely echo a previously reported problem are
+// dropped.
+func (d *Diagnostics) add(err error) {
+	switch e := err.(type) {
+	case nil:
+	case Diagnostics:
+		for _, err := range e {
+			d.add(err)
+		}
+	default:
+		if err == errBad {
+			return
+		}
+		*d = append(*d, err)
+	}
+}
+
+// errBad is returned when evaluating a node that failed to parse, or a
+// variable whose definition failed to evaluate. The underlying problem has
+// already been reported, so errBad is never itself a diagnostic.
+var errBad = errors.New("bad node")
+
+// joinPath appends a key or index to a slash-separated document path.
+func joinPath(path string, elem interface{}) string {
+	if path == "" {
+		return fmt.Sprint(elem)
+	}
+	return fmt.Sprintf("%s/%v", path, elem)
+}
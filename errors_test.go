@@ -0,0 +1,117 @@
+package moon
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSyntaxError(t *testing.T) {
+	_, err := ReadString("a: 1\nb: [1 2 }")
+	var e *SyntaxError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected a *SyntaxError, saw %T: %v", err, err)
+	}
+	if e.Pos.Line != 2 || e.Pos.Column != 9 {
+		t.Errorf("expected error at 2:9, saw %s", e.Pos)
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	_, err := ReadString("a: 1\nb: {c: @missing}")
+	var e *EvalError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected an *EvalError, saw %T: %v", err, err)
+	}
+	if e.Name != "missing" {
+		t.Errorf("expected error to name the variable 'missing', saw '%s'", e.Name)
+	}
+	if e.Pos.Line != 2 || e.Pos.Column != 8 {
+		t.Errorf("expected error at 2:8, saw %s", e.Pos)
+	}
+}
+
+func TestTypeError(t *testing.T) {
+	doc, err := ReadString("servers: [\n  {host: a; port: 80}\n  {host: b; port: eighty}\n]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Servers []struct {
+			Host string `name: host`
+			Port int    `name: port`
+		} `name: servers`
+	}
+	err = doc.Fill(&config)
+	var e *TypeError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected a *TypeError, saw %T: %v", err, err)
+	}
+	if e.Path != "servers/1/port" {
+		t.Errorf("expected path servers/1/port, saw %s", e.Path)
+	}
+	if e.Expected != reflect.TypeOf(0) || e.Actual != reflect.TypeOf("") {
+		t.Errorf("expected int and string types, saw %v and %v", e.Expected, e.Actual)
+	}
+	if e.Pos.Line != 3 || e.Pos.Column != 19 {
+		t.Errorf("expected error at 3:19, saw %s", e.Pos)
+	}
+}
+
+func TestRequiredFieldError(t *testing.T) {
+	doc, err := ReadString("db: {user: admin}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		DB struct {
+			User     string `name: user`
+			Password string `name: password; required: true`
+		} `name: db`
+	}
+	err = doc.Fill(&config)
+	var e *RequiredFieldError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected a *RequiredFieldError, saw %T: %v", err, err)
+	}
+	if e.Path != "db/password" || e.Field != "Password" {
+		t.Errorf("unexpected path or field in error: %v %v", e.Path, e.Field)
+	}
+}
+
+func TestFillDiagnostics(t *testing.T) {
+	doc, err := ReadString("host: 1\nport: eighty\nnames: [a\n2\nc]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Host  string   `name: host`
+		Port  int      `name: port`
+		User  string   `name: user; required: true`
+		Names []string `name: names`
+	}
+	err = doc.Fill(&config)
+	var diags Diagnostics
+	if !errors.As(err, &diags) {
+		t.Fatalf("expected Diagnostics, saw %T: %v", err, err)
+	}
+	paths := []string{"host", "port", "user", "names/1"}
+	if len(diags) != len(paths) {
+		t.Fatalf("expected %d diagnostics, saw %d: %v", len(paths), len(diags), diags)
+	}
+	for i, err := range diags {
+		var path string
+		switch e := err.(type) {
+		case *TypeError:
+			path = e.Path
+		case *RequiredFieldError:
+			path = e.Path
+		}
+		if path != paths[i] {
+			t.Errorf("expected diagnostic %d to be about %s, saw %v", i, paths[i], err)
+		}
+	}
+	if !reflect.DeepEqual(config.Names, []string{"a", "", "c"}) {
+		t.Errorf("expected valid list items to be filled, saw %v", config.Names)
+	}
+}
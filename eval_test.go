@@ -1,12 +1,15 @@
 package moon
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func runEvalTest(t *testing.T, basepath, inpath, outpath string) {
@@ -42,13 +45,44 @@ func runEvalTest(t *testing.T, basepath, inpath, outpath string) {
 		t.Errorf("unable to read moon doc from outfile: %s", err)
 		return
 	}
-	if !reflect.DeepEqual(inDoc, outDoc) {
+	if !sameValues(inDoc, outDoc) {
 		t.Errorf("test %d: input and output documents do not match!", n)
 		t.Logf("input document: %v", inDoc)
 		t.Logf("output document: %v", outDoc)
 	}
 }
 
+// sameValues compares two evaluated moon values, ignoring the source
+// positions recorded in objects.
+func sameValues(a, b interface{}) bool {
+	switch ta := a.(type) {
+	case *Object:
+		tb, ok := b.(*Object)
+		if !ok || len(ta.keys) != len(tb.keys) {
+			return false
+		}
+		for i, k := range ta.keys {
+			if tb.keys[i] != k || !sameValues(ta.items[k], tb.items[k]) {
+				return false
+			}
+		}
+		return true
+	case List:
+		tb, ok := b.(List)
+		if !ok || len(ta) != len(tb) {
+			return false
+		}
+		for i := range ta {
+			if !sameValues(ta[i], tb[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
 func TestEval(t *testing.T) {
 	files, err := filepath.Glob("tests/eval/*.in")
 	if err != nil {
@@ -60,3 +94,456 @@ func TestEval(t *testing.T) {
 		runEvalTest(t, "tests/eval/", fname, strings.Replace(fname, "in", "out", -1))
 	}
 }
+
+func TestEnv(t *testing.T) {
+	env := map[string]string{
+		"HOST":  "db.example.com",
+		"PORT":  "5432",
+		"DEBUG": "true",
+		"WAIT":  "30s",
+		"EMPTY": "",
+		"NAME":  " padded 1 ",
+		"DATE":  "2024-05-01",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	doc, err := ReadString(`
+		host: ${HOST}
+		port: ${PORT}
+		debug: ${DEBUG}
+		wait: ${WAIT}
+		name: ${NAME}
+		release: ${DATE}
+		user: ${USER:-admin}
+		empty: ${EMPTY:-fallback}
+		blank: ${EMPTY}
+		@pool: ${POOL:-10}
+		pools: [@pool ${HOST:-x}]
+	`, LookupEnv(lookup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"host":    "db.example.com",
+		"port":    5432,
+		"debug":   true,
+		"wait":    30 * time.Second,
+		"name":    " padded 1 ",
+		"release": "2024-05-01",
+		"user":    "admin",
+		"empty":   "fallback",
+		"blank":   "",
+		"pools":   List{10, "db.example.com"},
+	}
+	for k, v := range expected {
+		if !reflect.DeepEqual(doc.items[k], v) {
+			t.Errorf("%s: expected %#v, saw %#v", k, v, doc.items[k])
+		}
+	}
+
+	_, err = ReadString("a: 1\nb: ${MISSING}\n", LookupEnv(lookup))
+	if err == nil || err.Error() != "2:4: environment variable MISSING is not set" {
+		t.Errorf("expected an error for a missing variable, saw %v", err)
+	}
+
+	// with lookups disabled, only defaults are available
+	doc, err = ReadString("host: ${HOST:-localhost}\n", LookupEnv(nil))
+	if err != nil || doc.items["host"] != "localhost" {
+		t.Errorf("expected the default host, saw %v (%v)", doc.items["host"], err)
+	}
+	_, err = ReadString("host: ${HOST}\n", LookupEnv(nil))
+	var ee *EvalError
+	if !errors.As(err, &ee) || ee.Name != "HOST" || !strings.Contains(err.Error(), "lookups are disabled") {
+		t.Errorf("expected an error for a disabled lookup, saw %v", err)
+	}
+
+	if _, err := ReadString("a: ${not valid}\n"); err == nil {
+		t.Error("expected a syntax error for an invalid variable name")
+	}
+}
+
+func TestTimes(t *testing.T) {
+	doc, err := ReadString(`
+		@start: 2024-05-01T22:00:00+02:00
+		window: {
+			start: @start
+			end: (@start + 4h)
+		}
+		expires: 2025-01-01
+		expired: (@expires < 2024-06-01)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var window struct {
+		Start time.Time  `name: start`
+		End   *time.Time `name: end`
+	}
+	if err := doc.Get("window", &window); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+	if !window.Start.Equal(start) || window.End == nil || !window.End.Equal(start.Add(4*time.Hour)) {
+		t.Errorf("bad window: %v to %v", window.Start, window.End)
+	}
+	var expires time.Time
+	if err := doc.Get("expires", &expires); err != nil || !expires.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("bad expiry: %v (%v)", expires, err)
+	}
+	var s string
+	var te *TypeError
+	if err := doc.Get("expires", &s); !errors.As(err, &te) {
+		t.Errorf("expected a type error reading a time into a string, saw %v", err)
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"window":{"start":"2024-05-01T22:00:00+02:00","end":"2024-05-02T02:00:00+02:00"},"expires":"2025-01-01T00:00:00Z","expired":false}`
+	if string(b) != expected {
+		t.Errorf("expected %s, saw %s", expected, b)
+	}
+
+	doc, err = ReadString("@day: 2024-05-01\n@at: 2024-05-01T09:30:00Z\na: \"@{day} at @{at}\"")
+	if err != nil || doc.items["a"] != "2024-05-01 at 2024-05-01T09:30:00Z" {
+		t.Errorf("bad interpolated times: %#v (%v)", doc.items["a"], err)
+	}
+
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{`a: 2024-02-30`, "invalid timestamp: 2024-02-30"},
+		{`a: 2024-05-01T09:30:00`, "invalid timestamp: 2024-05-01T09:30:00"},
+		{`a: (2024-05-01 + 1)`, "invalid operation: time + int (mismatched types)"},
+		{`a: (2024-05-01 * 2024-05-01)`, "invalid operation: time * time (operator * not defined on time)"},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src)
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+}
+
+func TestHeredocs(t *testing.T) {
+	doc, err := ReadString(`
+		config: {
+			script: <<~SH
+				set -e
+				  exec app
+				SH
+			query: <<~SQL-
+				SELECT 1
+			SQL
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Script string `name: script`
+		Query  string `name: query`
+	}
+	if err := doc.Get("config", &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Script != "set -e\n  exec app\n" {
+		t.Errorf("bad script: %q", config.Script)
+	}
+	if config.Query != "SELECT 1" {
+		t.Errorf("bad query: %q", config.Query)
+	}
+
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"a: <<EOF\nx\n  EOF\n", "unexpected eof inside of heredoc EOF"},
+		{"a: <<~1X\nx\n1X\n", "unexpected rune in lexHeredocStart: 1 (heredoc labels are made of letters, digits and underscores)"},
+		{"a: <<X-Y\nx\nX\n", "unexpected rune in lexHeredocStart: - (heredoc labels are made of letters, digits and underscores)"},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src)
+		if err == nil || !strings.HasSuffix(err.Error(), test.msg) {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	doc, err := ReadString(`
+		@user: {name: ada; id: 7}
+		greeting: <<@END
+hello, @{user/name} (#@{user/id})
+END
+		script: <<~SH-
+			echo "@{user/name}"
+			SH
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := doc.items["greeting"]; v != "hello, ada (#7)\n" {
+		t.Errorf("bad greeting: %q", v)
+	}
+	// only heredocs opened with <<@ interpolate; others are verbatim
+	if v := doc.items["script"]; v != `echo "@{user/name}"` {
+		t.Errorf("bad script: %q", v)
+	}
+
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"@o: {a: 1}\nb: \"@{o}\"\n", `2:4: cannot interpolate @{o}: value is an object, not a scalar`},
+		{"l: [1 2]\nb: \"x @{l} y\"\n", `2:4: cannot interpolate @{l}: value is a list, not a scalar`},
+		{"b: \"@{nope}\"\n", `1:4: undefined variable: nope`},
+		{"o: {a: 1}\nb: \"@{o/b}\"\n", `2:4: unable to resolve o/b: no value found for path b`},
+		{"b: \"@{}\"\n", `1:4: parse error: empty reference in string`},
+		{"b: \"@{open\"\n", `1:4: parse error: unterminated reference in string: @{open`},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+
+	// a sigil or brace written as an escape sequence never begins a reference
+	doc, err = ReadString(`@x: 1; a: "\x40{x}"; b: "@\u007bx}"; c: "\x40{x} @{x}"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"a": "@{x}", "b": "@{x}", "c": "@{x} 1"} {
+		if v := doc.items[k]; v != want {
+			t.Errorf("%s: expected %q, saw %q", k, want, v)
+		}
+	}
+
+	// a literal @{ survives a round trip through Encode
+	doc, err = ReadString(`s: "@@{x} and @@@{y}"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Encode(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ReadBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := again.items["s"]; s != "@{x} and @@{y}" {
+		t.Errorf("bad round trip: %q", s)
+	}
+}
+
+func TestVariablePaths(t *testing.T) {
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"@o: {a: 1}\nb: @o/b\n", "2:4: unable to resolve o/b: no value found for path b"},
+		{"@l: [1 2]\nb: @l/2\n", "2:4: unable to resolve l/2: no value found for path 2"},
+		{"@o: {a: 1}\nb: @o/a/c\n", "2:4: unable to resolve o/a/c: can only key an Object, root is int"},
+		{"@o: {a: 1}\nb: @o/0\n", "2:4: unable to resolve o/0: can only index a List, root is *moon.Object"},
+		{"b: @nope/a\n", "1:4: undefined variable: nope"},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+
+	_, err := ReadString("@o: {a: 1}\nb: @o/b\n")
+	var nv NoValue
+	if !errors.As(err, &nv) {
+		t.Errorf("expected a NoValue error, saw %#v", err)
+	}
+
+	// a name containing a slash still refers to that name
+	doc, err := ReadString("@a/b: 1\nc: @a/b\n")
+	if err != nil || doc.items["c"] != 1 {
+		t.Errorf("expected c to be 1, saw %v (%v)", doc.items["c"], err)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	doc, err := ReadString(`
+		@base: {tls: {enabled: false}; ports: [80]}
+		a: {...@base; tls: {cert: x}}
+		b: @base
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled bool
+	var cert string
+	if err := doc.Get("a/tls/enabled", &enabled); err != nil || enabled {
+		t.Errorf("expected a/tls/enabled to be false, saw %v (%v)", enabled, err)
+	}
+	if err := doc.Get("a/tls/cert", &cert); err != nil || cert != "x" {
+		t.Errorf("expected a/tls/cert to be x, saw %q (%v)", cert, err)
+	}
+	// merging doesn't modify the object being extended
+	if err := doc.Get("b/tls/cert", &cert); err == nil {
+		t.Errorf("expected b/tls to have no cert, saw %q", cert)
+	}
+
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"@l: [1]\na: {...@l}\n", "2:5: cannot spread a list into an object"},
+		{"@o: {x: 1}\na: [...@o]\n", "2:5: cannot spread an object into a list"},
+		{"a: [...5]\n", "1:5: cannot spread a number into a list"},
+		{"a: {...@nope}\n", "1:8: undefined variable: nope"},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+
+	if _, err := ReadString("a: ...@b\n"); err == nil {
+		t.Error("expected a syntax error for a spread outside of an object or list")
+	}
+	if diags := Check(strings.NewReader("@l: [1]\na: {...@l; ...@l}\nb: [...@l]\n")); len(diags) != 2 {
+		t.Errorf("expected 2 diagnostics, saw %v", diags)
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	doc, err := ReadString(`
+		@n: 7
+		@d: 90s
+		sum: (@n + 3)
+		quotient: (@n / 2)
+		remainder: (@n % 2)
+		float: (@n * 0.5)
+		complex: (@n + 2i)
+		scaled: (@d * 2)
+		scaled_float: (@d * 1.5)
+		scaled_left: (2 * @d)
+		shrunk: (@d / 4)
+		shifted: (@d - 30s)
+		ratio: (@d / 30s)
+		negated: (-@d)
+		concat: ("a" + "b" + "c")
+		less: ("abc" < "abd")
+		equal: (@n == 7.0)
+		either: (false || @n != 7)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"sum":          10,
+		"quotient":     3,
+		"remainder":    1,
+		"float":        3.5,
+		"complex":      complex(7, 2),
+		"scaled":       3 * time.Minute,
+		"scaled_float": 135 * time.Second,
+		"scaled_left":  3 * time.Minute,
+		"shrunk":       22500 * time.Millisecond,
+		"shifted":      time.Minute,
+		"ratio":        3.0,
+		"negated":      -90 * time.Second,
+		"concat":       "abc",
+		"less":         true,
+		"equal":        true,
+		"either":       false,
+	}
+	for k, v := range expected {
+		if !reflect.DeepEqual(doc.items[k], v) {
+			t.Errorf("%s: expected %#v, saw %#v", k, v, doc.items[k])
+		}
+	}
+
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{`a: ("x" * 2)`, "1:9: invalid operation: string * int (mismatched types)"},
+		{`a: (1s * 1s)`, "1:8: invalid operation: duration * duration (operator * not defined on duration)"},
+		{`a: (1.5 % 2)`, "1:9: invalid operation: float % float (operator % not defined on float)"},
+		{`a: (1 / 0)`, "1:7: division by zero"},
+		{`a: (9223372036854775807 + 1)`, "1:25: integer overflow: 9223372036854775807 + 1"},
+		{`a: (true && 1)`, "1:10: invalid operation: bool && int (operator && is only defined on bool)"},
+		{`a: (-"x")`, "1:5: invalid operation: -string (operator - not defined on string)"},
+		{"@o: {}\na: (@o == @o)", "2:8: invalid operation: object == object (operator == not defined on object)"},
+		{`a: (1 +)`, "1:8: parse error: unexpected t_paren_close token in expression, expected a value"},
+		{`a: (1 2)`, "1:7: parse error: unexpected t_real_number token in expression, expected an operator or )"},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+
+	// the right operand of && and || is evaluated only when needed
+	if _, err := ReadString(`a: (false && @undefined)`); err != nil {
+		t.Errorf("expected && to short-circuit, saw %v", err)
+	}
+	if _, err := ReadString(`a: (foo + 1)`); err == nil || !strings.Contains(err.Error(), "must be quoted") {
+		t.Errorf("expected an error for an unquoted string, saw %v", err)
+	}
+
+	// a value that starts with ( has been an expression, not a bare string,
+	// since expressions were added; quoting keeps the old meaning
+	for _, src := range []string{`c: (hello)`, `note: (see below)`} {
+		if _, err := ReadString(src); err == nil || !strings.Contains(err.Error(), "must be quoted") {
+			t.Errorf("%q: expected an expression parse error, saw %v", src, err)
+		}
+	}
+	doc, err = ReadString("a: \"(see below)\"\nb: see (below)")
+	if err != nil || doc.items["a"] != "(see below)" || doc.items["b"] != "see (below)" {
+		t.Errorf("bad parenthesized strings: %#v %#v (%v)", doc.items["a"], doc.items["b"], err)
+	}
+	if diags := Check(strings.NewReader("a: (1 + \"x\")\nb: (2 +)\nc: (3)\n")); len(diags) != 2 {
+		t.Errorf("expected 2 diagnostics, saw %v", diags)
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	doc, err := ReadString(`
+		@n: 5
+		a: (@n > 3 ? "big" : "small")
+		b: (@n > 9 ? "big" : @n > 4 ? "medium" : "small")
+		c: (@n == 5 ? @n * 2 : 0)
+		d: (false ? @undefined : 1)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"a": "big", "b": "medium", "c": 10, "d": 1}
+	for k, v := range expected {
+		if !reflect.DeepEqual(doc.items[k], v) {
+			t.Errorf("%s: expected %#v, saw %#v", k, v, doc.items[k])
+		}
+	}
+
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{`a: (1 ? 2 : 3)`, "1:7: invalid condition: int is not a bool"},
+		{`a: (true ? 2)`, "1:13: parse error: unexpected t_paren_close token in conditional expression, expected :"},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src)
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+}
@@ -0,0 +1,701 @@
+package moon
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// A value may be computed from other values with an expression, written in
+// parentheses:
+//
+//   max_conns: (@workers * 4)
+//   timeout: (@base_timeout * 2 + 500ms)
+//   url: ("https://" + @host)
+//
+// Expressions support arithmetic on numbers and durations, concatenation of
+// strings, comparisons and boolean logic. Operands are checked when the
+// expression is evaluated; applying an operator to values it isn't defined on
+// is an error reported at the position of the operator.
+
+// precedence gives the binding power of each binary operator. Operators with
+// higher precedence bind more tightly.
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+// exprNode is a parenthesized expression.
+type exprNode struct {
+	pos Position
+	x   node
+}
+
+func (e *exprNode) Type() nodeType {
+	return n_expr
+}
+
+func (e *exprNode) Pos() Position {
+	return e.pos
+}
+
+func (e *exprNode) parse(p *parser) error {
+	t := p.next()
+	if t.t != t_paren_open {
+		return syntaxErrorf(t.pos, "unexpected %s token when parsing expression", t.t)
+	}
+	e.pos = t.pos
+	x, err := parseExpr(p)
+	if err != nil {
+		return err
+	}
+	e.x = x
+	switch t := p.next(); t.t {
+	case t_paren_close:
+		return nil
+	case t_error:
+		return syntaxErrorf(t.pos, "parse error: saw lex error while parsing expression: %v", t.s)
+	case t_eof:
+		return syntaxErrorf(t.pos, "parse error: unexpected eof in expression: missing )")
+	default:
+		return syntaxErrorf(t.pos, "parse error: unexpected %v token in expression, expected an operator or )", t.t)
+	}
+}
+
+func (e *exprNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%sexpr:\n", prefix)
+	return e.x.pretty(w, prefix+indent)
+}
+
+func (e *exprNode) eval(ctx *context) (interface{}, error) {
+	return e.x.eval(ctx)
+}
+
+// parseExpr parses an expression, which is either a conditional expression or
+// a sequence of operands joined by binary operators. Conditional expressions
+// bind least tightly of all, and associate to the right, so that
+// a ? b : c ? d : e means a ? b : (c ? d : e).
+func parseExpr(p *parser) (node, error) {
+	x, err := parseBinary(p, 1)
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.t != t_operator || t.s != "?" {
+		return x, nil
+	}
+	p.next()
+	n := &condNode{pos: t.pos, cond: x}
+	if n.then, err = parseExpr(p); err != nil {
+		return nil, err
+	}
+	if t := p.next(); t.t != t_operator || t.s != ":" {
+		return nil, syntaxErrorf(t.pos, "parse error: unexpected %v token in conditional expression, expected :", t.t)
+	}
+	if n.els, err = parseExpr(p); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// parseBinary parses a sequence of operands joined by binary operators with a
+// precedence of at least min.
+func parseBinary(p *parser, min int) (node, error) {
+	x, err := parseUnary(p)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec := precedence[t.s]
+		if t.t != t_operator || prec < min {
+			return x, nil
+		}
+		p.next()
+		y, err := parseBinary(p, prec+1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryNode{pos: t.pos, op: t.s, x: x, y: y}
+	}
+}
+
+func parseUnary(p *parser) (node, error) {
+	t := p.peek()
+	if t.t == t_operator {
+		switch t.s {
+		case "-", "+", "!":
+			p.next()
+			x, err := parseUnary(p)
+			if err != nil {
+				return nil, err
+			}
+			return &unaryNode{pos: t.pos, op: t.s, x: x}, nil
+		}
+	}
+	return parseOperand(p)
+}
+
+func parseOperand(p *parser) (node, error) {
+	var n node
+	switch t := p.peek(); t.t {
+	case t_paren_open:
+		n = new(exprNode)
+	case t_real_number, t_imaginary_number, t_duration, t_timestamp, t_bool, t_null, t_string, t_template, t_variable, t_env:
+		n = nodes[t.t](p)
+	case t_name:
+		n = new(callNode)
+	case t_error:
+		p.next()
+		return nil, syntaxErrorf(t.pos, "parse error: saw lex error while parsing expression: %v", t.s)
+	case t_eof:
+		return nil, syntaxErrorf(t.pos, "parse error: unexpected eof in expression: missing )")
+	default:
+		return nil, syntaxErrorf(t.pos, "parse error: unexpected %v token in expression, expected a value", t.t)
+	}
+	if err := n.parse(p); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// binaryNode applies a binary operator, e.g., @workers * 4.
+type binaryNode struct {
+	pos Position // position of the operator
+	op  string
+	x   node
+	y   node
+}
+
+func (b *binaryNode) Type() nodeType {
+	return n_binary
+}
+
+func (b *binaryNode) Pos() Position {
+	return b.x.Pos()
+}
+
+func (b *binaryNode) parse(p *parser) error {
+	return fmt.Errorf("binary nodes are parsed by parseBinary")
+}
+
+func (b *binaryNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%sbinary:\n", prefix)
+	fmt.Fprintf(w, "%s%s\n", prefix+indent, b.op)
+	if err := b.x.pretty(w, prefix+indent); err != nil {
+		return err
+	}
+	return b.y.pretty(w, prefix+indent)
+}
+
+func (b *binaryNode) eval(ctx *context) (interface{}, error) {
+	x, err := b.x.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if b.op == "&&" || b.op == "||" {
+		// the right operand is only evaluated if it's needed
+		v, ok := x.(bool)
+		if !ok {
+			return nil, evalErrorf(b.pos, "", "invalid operation: %s %s (operator %s is only defined on bool)", typeName(x), b.op, b.op)
+		}
+		if v == (b.op == "||") {
+			return v, nil
+		}
+		y, err := b.y.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := y.(bool); !ok {
+			return nil, evalErrorf(b.pos, "", "invalid operation: bool %s %s (operator %s is only defined on bool)", b.op, typeName(y), b.op)
+		}
+		return y, nil
+	}
+	y, err := b.y.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, err := operate(b.op, x, y)
+	if err != nil {
+		return nil, evalErrorf(b.pos, "", "%v", err)
+	}
+	return v, nil
+}
+
+// condNode is a conditional expression, e.g., @debug ? "verbose" : "quiet".
+// Only the chosen branch is evaluated.
+type condNode struct {
+	pos  Position // position of the ?
+	cond node
+	then node
+	els  node
+}
+
+func (c *condNode) Type() nodeType {
+	return n_cond
+}
+
+func (c *condNode) Pos() Position {
+	return c.cond.Pos()
+}
+
+func (c *condNode) parse(p *parser) error {
+	return fmt.Errorf("conditional nodes are parsed by parseExpr")
+}
+
+func (c *condNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%scond:\n", prefix)
+	for _, n := range []node{c.cond, c.then, c.els} {
+		if err := n.pretty(w, prefix+indent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *condNode) eval(ctx *context) (interface{}, error) {
+	v, err := c.cond.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, evalErrorf(c.pos, "", "invalid condition: %s is not a bool", typeName(v))
+	}
+	if b {
+		return c.then.eval(ctx)
+	}
+	return c.els.eval(ctx)
+}
+
+// unaryNode applies a unary operator, e.g., -@offset or !@debug.
+type unaryNode struct {
+	pos Position
+	op  string
+	x   node
+}
+
+func (u *unaryNode) Type() nodeType {
+	return n_unary
+}
+
+func (u *unaryNode) Pos() Position {
+	return u.pos
+}
+
+func (u *unaryNode) parse(p *parser) error {
+	return fmt.Errorf("unary nodes are parsed by parseUnary")
+}
+
+func (u *unaryNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%sunary:\n", prefix)
+	fmt.Fprintf(w, "%s%s\n", prefix+indent, u.op)
+	return u.x.pretty(w, prefix+indent)
+}
+
+func (u *unaryNode) eval(ctx *context) (interface{}, error) {
+	x, err := u.x.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch v := x.(type) {
+	case bool:
+		if u.op == "!" {
+			return !v, nil
+		}
+	case int:
+		switch u.op {
+		case "-":
+			if v == math.MinInt64 {
+				return nil, evalErrorf(u.pos, "", "integer overflow: -(%d)", v)
+			}
+			return -v, nil
+		case "+":
+			return v, nil
+		}
+	case float64:
+		switch u.op {
+		case "-":
+			return -v, nil
+		case "+":
+			return v, nil
+		}
+	case complex128:
+		switch u.op {
+		case "-":
+			return -v, nil
+		case "+":
+			return v, nil
+		}
+	case time.Duration:
+		switch u.op {
+		case "-":
+			return -v, nil
+		case "+":
+			return v, nil
+		}
+	}
+	return nil, evalErrorf(u.pos, "", "invalid operation: %s%s (operator %s not defined on %s)", u.op, typeName(x), u.op, typeName(x))
+}
+
+// typeName gives the name of the type of a value from a Moon document, for
+// use in error messages about expressions.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case complex128:
+		return "complex"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case time.Duration:
+		return "duration"
+	case time.Time:
+		return "time"
+	case *Object:
+		return "object"
+	case List:
+		return "list"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// operate applies the binary operator op to x and y. Numbers of different
+// types are converted to the more general of the two types: int to float, and
+// either to complex. Any value may be compared to null with == and !=.
+func operate(op string, x, y interface{}) (interface{}, error) {
+	if x == nil || y == nil {
+		switch op {
+		case "==":
+			return x == nil && y == nil, nil
+		case "!=":
+			return x != nil || y != nil, nil
+		}
+	}
+	switch a := x.(type) {
+	case int:
+		switch b := y.(type) {
+		case int:
+			return intOp(op, a, b)
+		case float64:
+			return floatOp(op, float64(a), b)
+		case complex128:
+			return complexOp(op, complex(float64(a), 0), b)
+		case time.Duration:
+			if op == "*" {
+				return durationOp(op, b, a)
+			}
+		}
+	case float64:
+		switch b := y.(type) {
+		case int:
+			return floatOp(op, a, float64(b))
+		case float64:
+			return floatOp(op, a, b)
+		case complex128:
+			return complexOp(op, complex(a, 0), b)
+		case time.Duration:
+			if op == "*" {
+				return durationOp(op, b, a)
+			}
+		}
+	case complex128:
+		switch b := y.(type) {
+		case int:
+			return complexOp(op, a, complex(float64(b), 0))
+		case float64:
+			return complexOp(op, a, complex(b, 0))
+		case complex128:
+			return complexOp(op, a, b)
+		}
+	case time.Duration:
+		switch b := y.(type) {
+		case time.Duration, int, float64:
+			return durationOp(op, a, y)
+		case time.Time:
+			if op == "+" {
+				return timeOp(op, b, a)
+			}
+		}
+	case time.Time:
+		switch y.(type) {
+		case time.Time, time.Duration:
+			return timeOp(op, a, y)
+		}
+	case string:
+		if b, ok := y.(string); ok {
+			return stringOp(op, a, b)
+		}
+	case bool:
+		if b, ok := y.(bool); ok {
+			switch op {
+			case "==":
+				return a == b, nil
+			case "!=":
+				return a != b, nil
+			}
+		}
+	}
+	return nil, undefinedOp(op, x, y)
+}
+
+func undefinedOp(op string, x, y interface{}) error {
+	if typeName(x) == typeName(y) {
+		return fmt.Errorf("invalid operation: %s %s %s (operator %s not defined on %s)", typeName(x), op, typeName(y), op, typeName(x))
+	}
+	return fmt.Errorf("invalid operation: %s %s %s (mismatched types)", typeName(x), op, typeName(y))
+}
+
+var errDivideByZero = fmt.Errorf("division by zero")
+
+func intOp(op string, a, b int) (interface{}, error) {
+	switch op {
+	case "+":
+		c := a + b
+		if (c > a) != (b > 0) {
+			return nil, fmt.Errorf("integer overflow: %d + %d", a, b)
+		}
+		return c, nil
+	case "-":
+		c := a - b
+		if (c < a) != (b > 0) {
+			return nil, fmt.Errorf("integer overflow: %d - %d", a, b)
+		}
+		return c, nil
+	case "*":
+		c, ok := mulInt64(int64(a), int64(b))
+		if !ok {
+			return nil, fmt.Errorf("integer overflow: %d * %d", a, b)
+		}
+		return int(c), nil
+	case "/", "%":
+		if b == 0 {
+			return nil, errDivideByZero
+		}
+		if a == math.MinInt64 && b == -1 {
+			return nil, fmt.Errorf("integer overflow: %d %s %d", a, op, b)
+		}
+		if op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	}
+	return compare(op, a, b, func() int {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	})
+}
+
+// mulInt64 multiplies two integers, reporting whether the product fits in
+// an int64.
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	if c/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return c, true
+}
+
+func floatOp(op string, a, b float64) (interface{}, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errDivideByZero
+		}
+		return a / b, nil
+	}
+	return compare(op, a, b, func() int {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	})
+}
+
+func complexOp(op string, a, b complex128) (interface{}, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errDivideByZero
+		}
+		return a / b, nil
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	}
+	return nil, undefinedOp(op, a, b)
+}
+
+// timeOp applies op to a time and either another time or a duration. A
+// duration may be added to or subtracted from a time, giving a time;
+// subtracting one time from another gives the duration between them; and
+// times may be compared.
+func timeOp(op string, a time.Time, y interface{}) (interface{}, error) {
+	switch b := y.(type) {
+	case time.Duration:
+		switch op {
+		case "+":
+			return a.Add(b), nil
+		case "-":
+			return a.Add(-b), nil
+		}
+	case time.Time:
+		if op == "-" {
+			return a.Sub(b), nil
+		}
+		return compare(op, a, b, func() int {
+			switch {
+			case a.Before(b):
+				return -1
+			case a.After(b):
+				return 1
+			}
+			return 0
+		})
+	}
+	return nil, undefinedOp(op, a, y)
+}
+
+// durationOp applies op to a duration and either another duration or a
+// number. Durations may be added to and subtracted from one another, and
+// scaled by numbers; dividing one duration by another gives their ratio.
+func durationOp(op string, a time.Duration, y interface{}) (interface{}, error) {
+	switch b := y.(type) {
+	case time.Duration:
+		switch op {
+		case "+":
+			c := a + b
+			if (c > a) != (b > 0) {
+				return nil, fmt.Errorf("duration overflow: %v + %v", a, b)
+			}
+			return c, nil
+		case "-":
+			c := a - b
+			if (c < a) != (b > 0) {
+				return nil, fmt.Errorf("duration overflow: %v - %v", a, b)
+			}
+			return c, nil
+		case "/":
+			if b == 0 {
+				return nil, errDivideByZero
+			}
+			return float64(a) / float64(b), nil
+		case "%":
+			if b == 0 {
+				return nil, errDivideByZero
+			}
+			return a % b, nil
+		}
+		return compare(op, a, b, func() int {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		})
+	case int:
+		switch op {
+		case "*":
+			c, ok := mulInt64(int64(a), int64(b))
+			if !ok {
+				return nil, fmt.Errorf("duration overflow: %v * %d", a, b)
+			}
+			return time.Duration(c), nil
+		case "/":
+			if b == 0 {
+				return nil, errDivideByZero
+			}
+			return a / time.Duration(b), nil
+		}
+	case float64:
+		var c float64
+		switch op {
+		case "*":
+			c = float64(a) * b
+		case "/":
+			if b == 0 {
+				return nil, errDivideByZero
+			}
+			c = float64(a) / b
+		default:
+			return nil, undefinedOp(op, a, y)
+		}
+		if c > math.MaxInt64 || c < math.MinInt64 {
+			return nil, fmt.Errorf("duration overflow: %v %s %v", a, op, b)
+		}
+		return time.Duration(math.Round(c)), nil
+	}
+	return nil, undefinedOp(op, a, y)
+}
+
+func stringOp(op string, a, b string) (interface{}, error) {
+	if op == "+" {
+		return a + b, nil
+	}
+	return compare(op, a, b, func() int {
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	})
+}
+
+// compare applies the comparison operator op to a and b, given a function
+// that orders them as -1, 0 or 1.
+func compare(op string, a, b interface{}, cmp func() int) (interface{}, error) {
+	switch op {
+	case "==":
+		return cmp() == 0, nil
+	case "!=":
+		return cmp() != 0, nil
+	case "<":
+		return cmp() < 0, nil
+	case "<=":
+		return cmp() <= 0, nil
+	case ">":
+		return cmp() > 0, nil
+	case ">=":
+		return cmp() >= 0, nil
+	}
+	return nil, undefinedOp(op, a, b)
+}
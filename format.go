@@ -0,0 +1,381 @@
+package moon
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// formatIndent is the indentation used for each level of nesting in
+// formatted documents.
+const formatIndent = "    "
+
+// Format reformats the Moon document in src into its canonical form. The
+// canonical form is defined as follows:
+//
+//   - each top-level assignment starts on its own line
+//   - lists and objects that were written on a single line and contain no
+//     comments stay on a single line; all others are written one item per
+//     line, indented four spaces per level of nesting
+//   - the values of consecutive assignments are aligned
+//   - strings are written bare whenever that doesn't change their meaning,
+//     and double-quoted otherwise
+//   - comments, variables, directives, heredocs and single blank lines are
+//     preserved
+//
+// Formatting a document never changes what it evaluates to.
+func Format(src []byte) ([]byte, error) {
+	f, err := ParseFile("", src)
+	if err != nil {
+		return nil, err
+	}
+	var p formatter
+	p.block(f.Nodes, 0, true)
+	if p.Len() > 0 {
+		p.WriteByte('\n')
+	}
+	return p.Bytes(), nil
+}
+
+type formatter struct {
+	bytes.Buffer
+}
+
+func (p *formatter) newline(depth int) {
+	p.WriteByte('\n')
+	for i := 0; i < depth; i++ {
+		p.WriteString(formatIndent)
+	}
+}
+
+// block writes a sequence of nodes one per line at the given depth. At the
+// top level of a document, the first node doesn't need a line break before
+// it; inside of a list or object it does.
+func (p *formatter) block(nodes []Node, depth int, top bool) {
+	widths := alignment(nodes)
+	for i, n := range nodes {
+		lead := leading(n)
+		if c, ok := n.(*Comment); ok && (i > 0 || !top) && !strings.Contains(lead, "\n") {
+			// a comment on the same line as whatever precedes it
+			p.WriteByte(' ')
+			p.WriteString(strings.TrimRight(c.Text, " \t\r"))
+			continue
+		}
+		if i > 0 || !top {
+			if i > 0 && strings.Count(lead, "\n") > 1 {
+				p.WriteByte('\n')
+			}
+			p.newline(depth)
+		}
+		switch n := n.(type) {
+		case *Comment:
+			p.WriteString(strings.TrimRight(n.Text, " \t\r"))
+		case *Assignment:
+			p.assignment(n, depth, widths[i])
+		default:
+			p.value(n, depth)
+		}
+	}
+}
+
+func (p *formatter) assignment(a *Assignment, depth int, width int) {
+	p.WriteString(a.Name.Text)
+	p.WriteByte(':')
+	pad := width - utf8.RuneCountInString(a.Name.Text)
+	if pad < 0 {
+		pad = 0
+	}
+	p.WriteString(strings.Repeat(" ", pad+1))
+	p.value(a.Value, depth)
+}
+
+func (p *formatter) value(n Node, depth int) {
+	switch n := n.(type) {
+	case *StringLit:
+		p.WriteString(formatString(n))
+	case *NumberLit:
+		p.WriteString(n.Text)
+		if n.Imag != nil {
+			p.WriteString(n.Imag.Text)
+		}
+	case *ListLit:
+		if !multiline(n) {
+			p.WriteByte('[')
+			for i, item := range n.Items {
+				if i > 0 {
+					p.WriteString(separator(n.Items[i-1]))
+				}
+				p.value(item, depth)
+			}
+			p.WriteByte(']')
+			return
+		}
+		p.WriteByte('[')
+		p.block(n.Items, depth+1, false)
+		p.newline(depth)
+		p.WriteByte(']')
+	case *ObjectLit:
+		if !multiline(n) {
+			p.WriteByte('{')
+			for i, field := range n.Fields {
+				if i > 0 {
+					p.WriteString("; ")
+				}
+				if a, ok := field.(*Assignment); ok {
+					p.assignment(a, depth, 0)
+				} else {
+					p.value(field, depth)
+				}
+			}
+			p.WriteByte('}')
+			return
+		}
+		p.WriteByte('{')
+		p.block(n.Fields, depth+1, false)
+		p.newline(depth)
+		p.WriteByte('}')
+	case *BoolLit:
+		p.WriteString(n.Text)
+	case *NullLit:
+		p.WriteString(n.Text)
+	case *DurationLit:
+		p.WriteString(n.Text)
+	case *TimeLit:
+		p.WriteString(n.Text)
+	case *VariableRef:
+		p.WriteString(n.Text)
+	case *EnvRef:
+		p.WriteString(n.Text)
+	case *Spread:
+		p.WriteString(n.Text)
+		p.value(n.Value, depth)
+	case *Expr:
+		p.expr(n)
+	case *Directive:
+		p.WriteString(n.Name.Text)
+		p.WriteByte(' ')
+		p.value(n.Value, depth)
+	}
+}
+
+// expr writes an expression. Expressions written on a single line without
+// comments are written with a single space around each binary operator, after
+// each comma, and nowhere else; all others are left as they are.
+func (p *formatter) expr(e *Expr) {
+	if multiline(e) {
+		e.Open.Leading = ""
+		var buf bytes.Buffer
+		e.writeTo(&buf)
+		p.Write(buf.Bytes())
+		return
+	}
+	p.WriteString(e.Open.Text)
+	prev, unary := e.Open.Text, false
+	for _, t := range e.Tokens {
+		switch {
+		case prev == "(", unary, t.Text == ")", t.Text == ",":
+		case t.Text == "(" && isFuncName(prev):
+		default:
+			p.WriteByte(' ')
+		}
+		p.WriteString(t.Text)
+		unary = isOperator(t.Text) && t.Text != "," && (prev == "(" || isOperator(prev))
+		prev = t.Text
+	}
+	p.WriteString(e.Close.Text)
+}
+
+// isFuncName determines whether the text of a token within an expression is
+// the name of a function.
+func isFuncName(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return (r == '_' || unicode.IsLetter(r)) && s != "true" && s != "false" && s != "null"
+}
+
+func isOperator(s string) bool {
+	for _, op := range operators {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+// alignment determines how wide the name column is for each assignment in a
+// block. Assignments on consecutive lines are aligned with one another; blank
+// lines, comments on lines of their own and values that span multiple lines
+// each end a run of aligned assignments.
+func alignment(nodes []Node) []int {
+	widths := make([]int, len(nodes))
+	start, max := 0, 0
+	flush := func(end int) {
+		for i := start; i < end; i++ {
+			if _, ok := nodes[i].(*Assignment); ok {
+				widths[i] = max
+			}
+		}
+		max = 0
+	}
+	for i, n := range nodes {
+		lead := leading(n)
+		switch n := n.(type) {
+		case *Assignment:
+			if strings.Count(lead, "\n") > 1 {
+				flush(i)
+				start = i
+			}
+			if multiline(n.Value) {
+				flush(i)
+				start = i + 1
+				continue
+			}
+			if w := utf8.RuneCountInString(n.Name.Text); w > max {
+				max = w
+			}
+		case *Comment:
+			if i == 0 || strings.Contains(lead, "\n") {
+				flush(i)
+				start = i + 1
+			}
+		}
+	}
+	flush(len(nodes))
+	return widths
+}
+
+// leading returns the text that precedes a node in its source.
+func leading(n Node) string {
+	switch n := n.(type) {
+	case *Comment:
+		return n.Leading
+	case *Assignment:
+		return n.Name.Leading
+	case *Directive:
+		return n.Name.Leading
+	case *StringLit:
+		return n.Leading
+	case *NumberLit:
+		return n.Leading
+	case *BoolLit:
+		return n.Leading
+	case *NullLit:
+		return n.Leading
+	case *DurationLit:
+		return n.Leading
+	case *TimeLit:
+		return n.Leading
+	case *VariableRef:
+		return n.Leading
+	case *EnvRef:
+		return n.Leading
+	case *Spread:
+		return n.Leading
+	case *Expr:
+		return n.Open.Leading
+	case *ListLit:
+		return n.Open.Leading
+	case *ObjectLit:
+		return n.Open.Leading
+	default:
+		return ""
+	}
+}
+
+// multiline determines whether a value is to be formatted across multiple
+// lines. Lists and objects are kept on one line only if they were written on
+// one line and contain no comments.
+func multiline(n Node) bool {
+	switch n := n.(type) {
+	case *StringLit:
+		return n.Quote() == '<'
+	case *Spread:
+		return multiline(n.Value)
+	case *Directive:
+		return multiline(n.Value)
+	case *Expr:
+		for _, t := range n.Tokens {
+			if strings.HasPrefix(t.Text, "#") || strings.Contains(t.Leading, "\n") {
+				return true
+			}
+		}
+		return strings.Contains(n.Close.Leading, "\n")
+	case *ListLit:
+		for _, item := range n.Items {
+			if _, ok := item.(*Comment); ok || multiline(item) || strings.Contains(leading(item), "\n") {
+				return true
+			}
+		}
+		return strings.Contains(n.Close.Leading, "\n")
+	case *ObjectLit:
+		for _, field := range n.Fields {
+			if _, ok := field.(*Comment); ok || strings.Contains(leading(field), "\n") {
+				return true
+			}
+			if a, ok := field.(*Assignment); ok && multiline(a.Value) {
+				return true
+			}
+			if sp, ok := field.(*Spread); ok && multiline(sp.Value) {
+				return true
+			}
+		}
+		return strings.Contains(n.Close.Leading, "\n")
+	default:
+		return false
+	}
+}
+
+// separator returns the text that separates a list item from the item that
+// follows it on the same line. Bare strings run until the end of the line, so
+// they have to be terminated explicitly.
+func separator(n Node) string {
+	switch n := n.(type) {
+	case *BoolLit, *NullLit:
+		return "; "
+	case *Spread:
+		return separator(n.Value)
+	case *Directive:
+		return separator(n.Value)
+	case *StringLit:
+		if !strings.HasPrefix(formatString(n), `"`) {
+			return "; "
+		}
+	}
+	return " "
+}
+
+// formatString gives the canonical representation of a string: heredocs are
+// left as they are, and other strings are written bare if they can be. Failing
+// that, raw strings are left as they are, and the rest are double-quoted.
+func formatString(s *StringLit) string {
+	if s.Quote() == '<' {
+		return s.Text
+	}
+	t := lexString(s.Text).nextToken()
+	v := t.s
+	if t.t != t_template && isBare(v) {
+		return v
+	}
+	if s.Quote() == '`' {
+		return s.Text
+	}
+	if t.t == t_string {
+		// a literal @{, which was written with an escape, is doubled so
+		// that it isn't read back as a reference
+		v = strings.Replace(v, "@{", "@@{", -1)
+	}
+	var buf bytes.Buffer
+	writeQuoted(&buf, v)
+	return buf.String()
+}
+
+// isBare determines whether a string can be written without quotes and still
+// be read back as the same string.
+func isBare(s string) bool {
+	if s == "" || s != strings.TrimSpace(s) || strings.ContainsAny(s, "\\\n") {
+		return false
+	}
+	l := lexString(s)
+	t := l.nextToken()
+	return t.t == t_string && t.s == s && l.nextToken().t == t_eof
+}
@@ -0,0 +1,96 @@
+package moon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var formatTests = []struct {
+	in  string
+	out string
+}{
+	{"", ""},
+	{"a:1", "a: 1\n"},
+	{"  name:   jordan\n\n\n\nage: 29", "name: jordan\n\nage: 29\n"},
+	{"a: 1; b: 2", "a: 1\nb: 2\n"},
+	{"host: localhost\nport: 9000\n", "host: localhost\nport: 9000\n"},
+	{"first_name: jordan\nlast: orelli\n", "first_name: jordan\nlast:       orelli\n"},
+	{"city: \"Brooklyn\"\nquoted: \"true\"\n", "city:   Brooklyn\nquoted: \"true\"\n"},
+	{"s: `it's \"quoted\"`", "s: it's \"quoted\"\n"},
+	{"s: 'single'\nr: `C:\\dir`\nt: `@{x}`", "s: single\nr: `C:\\dir`\nt: `@{x}`\n"},
+	{"s: \" padded \"", "s: \" padded \"\n"},
+	{"e: \"\\x40{x}\"\nt: \"@{x} \\x40{y}\"", "e: \"@@{x}\"\nt: \"@{x} @@{y}\"\n"},
+	{"n: \"12\"\nd: \"30s\"\nv: \"@var\"\n", "n: \"12\"\nd: \"30s\"\nv: \"@var\"\n"},
+	{"list: [ one;two;   three]", "list: [one; two; three]\n"},
+	{"list: [1 2 \"a b\" true; false; \"x;y\"]", "list: [1 2 a b; true; false; \"x;y\"]\n"},
+	{"obj: {  a: 1 b: two}", "obj: {a: 1; b: two}\n"},
+	{
+		"obj: {\n  short: 1\n  much_longer: 2 # trailing\n  # own line\n  x: [1\n 2]\n}",
+		"obj: {\n    short:       1\n    much_longer: 2 # trailing\n    # own line\n    x: [\n        1\n        2\n    ]\n}\n",
+	},
+	{"@hidden: {a: 1}\nshown: @hidden", "@hidden: {a: 1}\nshown:   @hidden\n"},
+	{"c: 1+2i\nx: 0x1F\n", "c: 1+2i\nx: 0x1F\n"},
+	{"a: {  ...@d;b: 1}\nl: [ ...@x  2]", "a: {...@d; b: 1}\nl: [...@x 2]\n"},
+	{"a: ( @n*-4+(1 - 2) )\nb: (! @x)\nc: [(1+2) 3]", "a: (@n * -4 + (1 - 2))\nb: (!@x)\nc: [(1 + 2) 3]\n"},
+	{"a: (1 +  # one\n  2)", "a: (1 +  # one\n  2)\n"},
+	{"doc: <<EOF\n  keep   this\nEOF\nnext: 1", "doc: <<EOF\n  keep   this\nEOF\nnext: 1\n"},
+	{"# header\n\n\na: 1 # note   \n", "# header\n\na: 1 # note\n"},
+}
+
+func TestFormat(t *testing.T) {
+	for _, test := range formatTests {
+		out, err := Format([]byte(test.in))
+		if err != nil {
+			t.Errorf("unable to format %q: %s", test.in, err)
+			continue
+		}
+		if string(out) != test.out {
+			t.Errorf("formatting %q: expected\n%s\nsaw\n%s", test.in, test.out, out)
+		}
+	}
+}
+
+// formatting a document must not change its meaning, and formatting it a
+// second time must not change it further.
+func TestFormatPreservesMeaning(t *testing.T) {
+	files, err := filepath.Glob("tests/*/*.in")
+	if err != nil {
+		t.Fatalf("unable to find test files: %s", err)
+	}
+	files = append(files, "ex.moon")
+
+	for _, fname := range files {
+		src, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Errorf("unable to read %s: %s", fname, err)
+			continue
+		}
+		before, err := ReadBytes(src)
+		if err != nil {
+			continue
+		}
+		once, err := Format(src)
+		if err != nil {
+			t.Errorf("unable to format %s: %s", fname, err)
+			continue
+		}
+		after, err := ReadBytes(once)
+		if err != nil {
+			t.Errorf("formatted %s is invalid: %s\n%s", fname, err, once)
+			continue
+		}
+		if !sameValues(before, after) {
+			t.Errorf("formatting %s changed its meaning:\n%s", fname, once)
+		}
+		twice, err := Format(once)
+		if err != nil {
+			t.Errorf("unable to reformat %s: %s", fname, err)
+			continue
+		}
+		if !bytes.Equal(once, twice) {
+			t.Errorf("formatting %s is not idempotent:\n%s\n---\n%s", fname, once, twice)
+		}
+	}
+}
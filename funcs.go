@@ -0,0 +1,439 @@
+package moon
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Functions may be called from within an expression, as in (upper(@name)) or
+// (join(keys(@servers), ",")). Moon comes with a small library of built-in
+// functions, and host programs may register functions of their own.
+
+// Func is a function that may be called from a Moon document. Its arguments
+// are Moon values: int, float64, complex128, string, bool, time.Duration,
+// time.Time, *Object, List or nil, for null. It must return a value of one of
+// those types as well.
+// Functions are expected to be pure: given the same arguments, a function
+// should always give the same result.
+type Func func(args ...interface{}) (interface{}, error)
+
+// Funcs is a set of functions to be made available to documents, by name.
+type Funcs map[string]Func
+
+// Functions registers functions for documents to call. A function registered
+// under the name of a built-in function takes its place.
+func Functions(fns Funcs) Option {
+	return func(c *context) {
+		if c.funcs == nil {
+			c.funcs = make(Funcs, len(fns))
+		}
+		for name, fn := range fns {
+			c.funcs[name] = fn
+		}
+	}
+}
+
+// Sandbox disables the built-in functions that read from the file system,
+// so that evaluating a document can't reveal the contents of arbitrary files.
+func Sandbox() Option {
+	return func(c *context) { c.sandbox = true }
+}
+
+// builtin is a function that comes with Moon. Unlike a Func, a builtin has
+// access to the context that it's called in.
+type builtin struct {
+	fn    func(ctx *context, args []interface{}) (interface{}, error)
+	files bool // whether the function reads from the file system
+}
+
+// builtins are the functions that come with Moon, apart from default, which
+// is evaluated specially by callNode.
+var builtins = map[string]builtin{
+	"len":     {fn: builtinLen},
+	"upper":   {fn: stringFunc(strings.ToUpper)},
+	"lower":   {fn: stringFunc(strings.ToLower)},
+	"join":    {fn: builtinJoin},
+	"split":   {fn: builtinSplit},
+	"keys":    {fn: builtinKeys},
+	"env":     {fn: builtinEnv},
+	"file":    {fn: builtinFile, files: true},
+	"base64":  {fn: stringFunc(encodeBase64)},
+	"sha256":  {fn: stringFunc(hashSHA256)},
+	"min":     {fn: extremum("<")},
+	"max":     {fn: extremum(">")},
+	"range":   {fn: builtinRange},
+	"profile": {fn: builtinProfile},
+}
+
+// callNode is a function call within an expression, e.g., len(@servers).
+type callNode struct {
+	pos  Position
+	name string
+	args []node
+}
+
+func (c *callNode) Type() nodeType {
+	return n_call
+}
+
+func (c *callNode) Pos() Position {
+	return c.pos
+}
+
+func (c *callNode) parse(p *parser) error {
+	t := p.next()
+	if t.t != t_name {
+		return syntaxErrorf(t.pos, "unexpected %s token when parsing function call", t.t)
+	}
+	c.pos = t.pos
+	c.name = t.s
+	if p.peek().t != t_paren_open {
+		return syntaxErrorf(t.pos, "parse error: unexpected %q in expression: strings in expressions must be quoted", t.s)
+	}
+	p.next()
+	if p.peek().t == t_paren_close {
+		p.next()
+		return nil
+	}
+	for {
+		arg, err := parseExpr(p)
+		if err != nil {
+			return err
+		}
+		c.args = append(c.args, arg)
+		switch t := p.next(); {
+		case t.t == t_paren_close:
+			return nil
+		case t.t == t_operator && t.s == ",":
+		case t.t == t_error:
+			return syntaxErrorf(t.pos, "parse error: saw lex error while parsing arguments to %s: %v", c.name, t.s)
+		default:
+			return syntaxErrorf(t.pos, "parse error: unexpected %v token in arguments to %s, expected , or )", t.t, c.name)
+		}
+	}
+}
+
+func (c *callNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%scall:\n", prefix)
+	fmt.Fprintf(w, "%s%s\n", prefix+indent, c.name)
+	for _, arg := range c.args {
+		if err := arg.pretty(w, prefix+indent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *callNode) eval(ctx *context) (interface{}, error) {
+	fn, isFunc := ctx.funcs[c.name]
+	if !isFunc && c.name == "default" {
+		return c.evalDefault(ctx)
+	}
+	b, isBuiltin := builtins[c.name]
+	if !isFunc && !isBuiltin {
+		return nil, evalErrorf(c.pos, c.name, "undefined function: %s", c.name)
+	}
+	if !isFunc && b.files && ctx.sandbox {
+		return nil, evalErrorf(c.pos, c.name, "%s: reading files is disabled in the sandbox", c.name)
+	}
+
+	args := make([]interface{}, len(c.args))
+	for i, arg := range c.args {
+		v, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	var (
+		v   interface{}
+		err error
+	)
+	if isFunc {
+		v, err = fn(args...)
+		if err == nil && !isValue(v) {
+			err = fmt.Errorf("returned a value of unsupported type %T", v)
+		}
+	} else {
+		v, err = b.fn(ctx, args)
+	}
+	if err != nil {
+		return nil, &EvalError{Pos: c.pos, Name: c.name, Msg: c.name, Err: err}
+	}
+	return v, nil
+}
+
+// evalDefault evaluates default(value, fallback), which gives value unless
+// it refers to something that isn't defined, in which case it gives
+// fallback. The fallback is only evaluated if it's needed.
+func (c *callNode) evalDefault(ctx *context) (interface{}, error) {
+	if len(c.args) != 2 {
+		return nil, evalErrorf(c.pos, c.name, "default: expected 2 arguments, saw %d", len(c.args))
+	}
+	v, err := c.args[0].eval(ctx)
+	var ee *EvalError
+	switch {
+	case err == nil && v != nil:
+		return v, nil
+	case err != nil && !(errors.As(err, &ee) && ee.undefined):
+		return nil, err
+	}
+	return c.args[1].eval(ctx)
+}
+
+// isValue determines whether v is of one of the types that make up a Moon
+// document.
+func isValue(v interface{}) bool {
+	switch v.(type) {
+	case int, float64, complex128, string, bool, time.Duration, time.Time, *Object, List, nil:
+		return true
+	default:
+		return false
+	}
+}
+
+// arity checks that a function was given at least min and at most max
+// arguments. A max of -1 means that there is no maximum.
+func arity(args []interface{}, min, max int) error {
+	if len(args) >= min && (max < 0 || len(args) <= max) {
+		return nil
+	}
+	switch {
+	case min == max:
+		return fmt.Errorf("expected %d arguments, saw %d", min, len(args))
+	case max < 0:
+		return fmt.Errorf("expected at least %d arguments, saw %d", min, len(args))
+	default:
+		return fmt.Errorf("expected %d to %d arguments, saw %d", min, max, len(args))
+	}
+}
+
+func argError(n int, expected string, v interface{}) error {
+	return fmt.Errorf("argument %d must be %s, not %s", n+1, expected, typeName(v))
+}
+
+// stringFunc makes a builtin of a function from one string to another.
+func stringFunc(fn func(string) string) func(*context, []interface{}) (interface{}, error) {
+	return func(ctx *context, args []interface{}) (interface{}, error) {
+		if err := arity(args, 1, 1); err != nil {
+			return nil, err
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, argError(0, "a string", args[0])
+		}
+		return fn(s), nil
+	}
+}
+
+// base64(s) gives the standard base64 encoding of a string.
+func encodeBase64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// sha256(s) gives the SHA-256 hash of a string, in hexadecimal.
+func hashSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// len(v) gives the number of characters in a string or the number of items
+// in a list or object.
+func builtinLen(ctx *context, args []interface{}) (interface{}, error) {
+	if err := arity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	switch v := args[0].(type) {
+	case string:
+		return utf8.RuneCountInString(v), nil
+	case List:
+		return len(v), nil
+	case *Object:
+		return len(v.keys), nil
+	default:
+		return nil, argError(0, "a string, list or object", v)
+	}
+}
+
+// join(list, sep) joins the items of a list into a single string.
+func builtinJoin(ctx *context, args []interface{}) (interface{}, error) {
+	if err := arity(args, 2, 2); err != nil {
+		return nil, err
+	}
+	l, ok := args[0].(List)
+	if !ok {
+		return nil, argError(0, "a list", args[0])
+	}
+	sep, ok := args[1].(string)
+	if !ok {
+		return nil, argError(1, "a string", args[1])
+	}
+	parts := make([]string, len(l))
+	for i, item := range l {
+		switch item.(type) {
+		case *Object, List, nil:
+			return nil, fmt.Errorf("item %d of the list is %s, not a scalar", i, describe(item))
+		}
+		parts[i] = fmt.Sprint(item)
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// split(s, sep) splits a string into a list of strings.
+func builtinSplit(ctx *context, args []interface{}) (interface{}, error) {
+	if err := arity(args, 2, 2); err != nil {
+		return nil, err
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, argError(0, "a string", args[0])
+	}
+	sep, ok := args[1].(string)
+	if !ok {
+		return nil, argError(1, "a string", args[1])
+	}
+	parts := strings.Split(s, sep)
+	out := make(List, len(parts))
+	for i, part := range parts {
+		out[i] = part
+	}
+	return out, nil
+}
+
+// keys(obj) gives the names of an object's items, in order.
+func builtinKeys(ctx *context, args []interface{}) (interface{}, error) {
+	if err := arity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	o, ok := args[0].(*Object)
+	if !ok {
+		return nil, argError(0, "an object", args[0])
+	}
+	out := make(List, len(o.keys))
+	for i, k := range o.keys {
+		out[i] = k
+	}
+	return out, nil
+}
+
+// env(name) gives the value of an environment variable as a string, and
+// env(name, fallback) gives fallback if the variable isn't set.
+func builtinEnv(ctx *context, args []interface{}) (interface{}, error) {
+	if err := arity(args, 1, 2); err != nil {
+		return nil, err
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, argError(0, "a string", args[0])
+	}
+	if ctx.env != nil {
+		if v, ok := ctx.env(name); ok {
+			return v, nil
+		}
+	}
+	if len(args) == 2 {
+		return args[1], nil
+	}
+	if ctx.env == nil {
+		return nil, fmt.Errorf("environment variable %s has no default and environment lookups are disabled", name)
+	}
+	return nil, fmt.Errorf("environment variable %s is not set", name)
+}
+
+// file(path) gives the contents of a file as a string. Relative paths are
+// relative to the document.
+func builtinFile(ctx *context, args []interface{}) (interface{}, error) {
+	if err := arity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, ok := args[0].(string)
+	if !ok {
+		return nil, argError(0, "a string", args[0])
+	}
+	name = ctx.resolve(name)
+	var (
+		b   []byte
+		err error
+	)
+	if ctx.fsys != nil {
+		b, err = fs.ReadFile(ctx.fsys, name)
+	} else {
+		b, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// extremum makes the builtins min and max, which give the least or greatest
+// of their arguments, or of the items of a list given as their only argument.
+func extremum(op string) func(*context, []interface{}) (interface{}, error) {
+	return func(ctx *context, args []interface{}) (interface{}, error) {
+		if err := arity(args, 1, -1); err != nil {
+			return nil, err
+		}
+		if l, ok := args[0].(List); ok && len(args) == 1 {
+			if len(l) == 0 {
+				return nil, fmt.Errorf("the list is empty")
+			}
+			args = l
+		}
+		best := args[0]
+		for _, v := range args[1:] {
+			better, err := operate(op, v, best)
+			if err != nil {
+				return nil, err
+			}
+			if better.(bool) {
+				best = v
+			}
+		}
+		return best, nil
+	}
+}
+
+// maxRange is the most items that range will produce.
+const maxRange = 1 << 20
+
+// range(n) gives the list of integers from 0 up to but not including n.
+// range(start, end) starts at start instead, and range(start, end, step)
+// counts by step.
+func builtinRange(ctx *context, args []interface{}) (interface{}, error) {
+	if err := arity(args, 1, 3); err != nil {
+		return nil, err
+	}
+	bounds := []int{0, 0, 1}
+	for i, arg := range args {
+		n, ok := arg.(int)
+		if !ok {
+			return nil, argError(i, "an int", arg)
+		}
+		bounds[i] = n
+	}
+	if len(args) == 1 {
+		bounds[0], bounds[1] = 0, bounds[0]
+	}
+	start, end, step := bounds[0], bounds[1], bounds[2]
+	if step == 0 {
+		return nil, fmt.Errorf("step must not be zero")
+	}
+	out := make(List, 0)
+	for i := start; (step > 0 && i < end) || (step < 0 && i > end); i += step {
+		if len(out) == maxRange {
+			return nil, fmt.Errorf("too many items: the limit is %d", maxRange)
+		}
+		out = append(out, i)
+	}
+	return out, nil
+}
@@ -0,0 +1,157 @@
+package moon
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFunctions(t *testing.T) {
+	fns := Funcs{
+		"double": func(args ...interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, errors.New("expected one argument")
+			}
+			n, ok := args[0].(int)
+			if !ok {
+				return nil, errors.New("expected an int")
+			}
+			return n * 2, nil
+		},
+		"upper": func(args ...interface{}) (interface{}, error) {
+			return "overridden", nil
+		},
+		"bad": func(args ...interface{}) (interface{}, error) {
+			return []string{"not", "a", "moon", "value"}, nil
+		},
+		"epoch": func(args ...interface{}) (interface{}, error) {
+			return time.Unix(0, 0).UTC(), nil
+		},
+		"nothing": func(args ...interface{}) (interface{}, error) {
+			return nil, nil
+		},
+	}
+
+	doc, err := ReadString(`
+		a: (double(21))
+		b: (upper("x"))
+		c: (lower("X"))
+		d: (epoch())
+		e: (nothing())
+	`, Functions(fns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"a": 42, "b": "overridden", "c": "x", "d": time.Unix(0, 0).UTC(), "e": nil}
+	for k, v := range expected {
+		if !reflect.DeepEqual(doc.items[k], v) {
+			t.Errorf("%s: expected %#v, saw %#v", k, v, doc.items[k])
+		}
+	}
+
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{`a: (double("x"))`, "1:5: double: expected an int"},
+		{`a: (bad())`, "1:5: bad: returned a value of unsupported type []string"},
+		{`a: (nope(1))`, "1:5: undefined function: nope"},
+		{`a: (len(1, 2))`, "1:5: len: expected 1 arguments, saw 2"},
+		{`a: (len(1))`, "1:5: len: argument 1 must be a string, list or object, not int"},
+		{`a: (range(1, 2, 0))`, "1:5: range: step must not be zero"},
+		{`a: (range(10000000))`, "1:5: range: too many items: the limit is 1048576"},
+		{`a: (min("a", 1))`, "1:5: min: invalid operation: int < string (mismatched types)"},
+		{"@l: [1 [2]]\na: (join(@l, \",\"))", "2:5: join: item 1 of the list is a list, not a scalar"},
+		{`a: (env("MOON_TEST_UNSET"))`, "1:5: env: environment variable MOON_TEST_UNSET is not set"},
+		{`a: (default(1))`, "1:5: default: expected 2 arguments, saw 1"},
+		{`a: (default(nope(1), 2))`, "1:13: undefined function: nope"},
+		{`a: (len)`, `1:5: parse error: unexpected "len" in expression: strings in expressions must be quoted`},
+		{`a: (len(1 2))`, "1:11: parse error: unexpected t_real_number token in arguments to len, expected , or )"},
+		{`a: (max([1 2]))`, "1:10: parse error: saw lex error while parsing expression: unexpected rune in expression: [ (a list in an expression has to come from a variable or a function)"},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src, Functions(fns), LookupEnv(func(string) (string, bool) { return "", false }))
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+}
+
+func TestDefault(t *testing.T) {
+	doc, err := ReadString(`
+		@o: {a: 1; l: [1]}
+		undefined: (default(@nope, 1))
+		missing_key: (default(@o/b, 2))
+		missing_index: (default(@o/l/3, 3))
+		present: (default(@o/a, 4))
+		lazy: (default(@o/a, @nope))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"undefined": 1, "missing_key": 2, "missing_index": 3, "present": 1, "lazy": 1}
+	for k, v := range expected {
+		if !reflect.DeepEqual(doc.items[k], v) {
+			t.Errorf("%s: expected %#v, saw %#v", k, v, doc.items[k])
+		}
+	}
+
+	// errors other than a missing value aren't papered over
+	if _, err := ReadString("@o: {a: 1}\nb: (default(@o/a/c, 1))\n"); err == nil {
+		t.Error("expected an error for a path through a non-object")
+	}
+	if _, err := ReadString("b: (default(1 + \"x\", 1))\n"); err == nil {
+		t.Error("expected an error for an invalid expression")
+	}
+}
+
+func TestEnvFunc(t *testing.T) {
+	lookup := LookupEnv(func(name string) (string, bool) {
+		if name == "PORT" {
+			return "8080", true
+		}
+		return "", false
+	})
+	doc, err := ReadString(`port: (env("PORT")); host: (env("HOST", "localhost"))`, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unlike ${PORT}, env gives strings
+	if doc.items["port"] != "8080" || doc.items["host"] != "localhost" {
+		t.Errorf("bad environment values: %#v %#v", doc.items["port"], doc.items["host"])
+	}
+	_, err = ReadString(`port: (env("PORT"))`, LookupEnv(nil))
+	if err == nil || !strings.Contains(err.Error(), "lookups are disabled") {
+		t.Errorf("expected an error for a disabled lookup, saw %v", err)
+	}
+}
+
+func TestFileFunc(t *testing.T) {
+	fsys := fstest.MapFS{
+		"conf/main.moon": {Data: []byte(`motd: (file("motd.txt")); size: (len(file("../data/blob")))`)},
+		"conf/motd.txt":  {Data: []byte("hello\n")},
+		"data/blob":      {Data: []byte("12345")},
+	}
+	doc, err := ReadFS(fsys, "conf/main.moon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.items["motd"] != "hello\n" || doc.items["size"] != 5 {
+		t.Errorf("bad file contents: %#v %#v", doc.items["motd"], doc.items["size"])
+	}
+
+	_, err = ReadFS(fsys, "conf/main.moon", Sandbox())
+	if err == nil || err.Error() != "conf/main.moon:1:8: file: reading files is disabled in the sandbox" {
+		t.Errorf("expected file to be disabled in the sandbox, saw %v", err)
+	}
+
+	// the sandbox doesn't affect functions registered by the host
+	file := func(args ...interface{}) (interface{}, error) { return "stub", nil }
+	doc, err = ReadString(`a: (file("x"))`, Sandbox(), Functions(Funcs{"file": file}))
+	if err != nil || doc.items["a"] != "stub" {
+		t.Errorf("expected a stubbed file function, saw %v (%v)", doc.items["a"], err)
+	}
+}
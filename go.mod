@@ -1,3 +1,3 @@
 module github.com/jordanorelli/moon
 
-go 1.12
+go 1.16
@@ -0,0 +1,210 @@
+package moon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A document may include other documents with the %include directive:
+//
+//   %include "shared/logging.moon"
+//
+// The included document is evaluated on its own, and every value it defines,
+// public or hidden, becomes part of the including document, exactly as if it
+// had been assigned at the point of the directive. The path of an included
+// document is resolved relative to the document that includes it.
+//
+// Each document is read only once, however many times it is included. A
+// document that is included again, directly or by way of another included
+// document, gives the same values as the first time, and those values are not
+// re-declarations of themselves. This lets two documents share a third.
+
+// parseDirective parses the directive introduced by the token t at the top
+// level of a document. The only such directive at present is %include.
+func parseDirective(p *parser, t token) (node, error) {
+	switch t.s {
+	case "include":
+		n := &includeNode{pos: t.pos}
+		if err := n.parse(p); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case "profile":
+		return nil, syntaxErrorf(t.pos, "parse error: %%profile is a value, and must be assigned to a name")
+	default:
+		return nil, syntaxErrorf(t.pos, "parse error: unknown directive %%%s", t.s)
+	}
+}
+
+type includeNode struct {
+	pos  Position
+	path string
+}
+
+func (n *includeNode) Type() nodeType {
+	return n_include
+}
+
+func (n *includeNode) Pos() Position {
+	return n.pos
+}
+
+func (n *includeNode) parse(p *parser) error {
+	t := p.next()
+	switch t.t {
+	case t_error:
+		return syntaxErrorf(t.pos, "parse error: saw lex error while parsing include: %v", t.s)
+	case t_string:
+		n.path = t.s
+		return nil
+	default:
+		return syntaxErrorf(t.pos, "parse error: unexpected %v token after %%include, expected a file name", t.t)
+	}
+}
+
+func (n *includeNode) String() string {
+	return fmt.Sprintf("{include: %s}", n.path)
+}
+
+func (n *includeNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%sinclude:\n", prefix)
+	fmt.Fprintf(w, "%s%s%s\n", prefix, indent, n.path)
+	return nil
+}
+
+func (n *includeNode) eval(ctx *context) (interface{}, error) {
+	name := ctx.resolve(n.path)
+	chain := append(append([]string{}, ctx.chain...), ctx.file)
+	for _, f := range chain {
+		if f == name {
+			return nil, evalErrorf(n.pos, "", "include cycle: %s", strings.Join(append(chain, name), " -> "))
+		}
+	}
+
+	if ctx.docs == nil {
+		ctx.docs = make(map[string]*context)
+	}
+	inc, ok := ctx.docs[name]
+	if !ok {
+		var err error
+		inc, err = ctx.include(name, chain)
+		if err != nil {
+			return nil, &IncludeError{Pos: n.pos, Path: name, Err: err}
+		}
+		ctx.docs[name] = inc
+	}
+	if ctx.from == nil {
+		ctx.from = make(map[string]string)
+	}
+
+	for _, k := range inc.public.keys {
+		dup, err := ctx.shared(k, inc, name, n.pos, "%s")
+		if err != nil {
+			return nil, err
+		}
+		if !dup {
+			ctx.public.set(k, inc.public.items[k], inc.public.pos[k])
+		}
+	}
+	keys := make([]string, 0, len(inc.private))
+	for k := range inc.private {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		dup, err := ctx.shared(k, inc, name, n.pos, "@%s")
+		if err != nil {
+			return nil, err
+		}
+		if !dup {
+			ctx.private[k] = inc.private[k]
+		}
+	}
+	return nil, nil
+}
+
+// shared checks the name k, defined by the included document inc, before it
+// is brought into the context. It reports whether the context already has
+// the same value from the same document, in which case there is nothing to
+// do. A different value of the same name is an error.
+func (c *context) shared(k string, inc *context, name string, pos Position, format string) (bool, error) {
+	src, ok := inc.from[k]
+	if !ok {
+		src = name
+	}
+	if _, ok := c.get(k); ok {
+		if c.from[k] == src {
+			return true, nil
+		}
+		return false, evalErrorf(pos, k, "invalid re-declaration: "+format+" (included from %s)", k, name)
+	}
+	c.from[k] = src
+	return false, nil
+}
+
+// resolve gives the name of an included document. Relative paths are taken
+// to be relative to the directory of the including document.
+func (c *context) resolve(name string) string {
+	if c.fsys != nil {
+		return path.Join(path.Dir(c.file), name)
+	}
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name)
+	}
+	return filepath.Join(filepath.Dir(c.file), name)
+}
+
+// include reads and evaluates the named document, giving back the context
+// that it was evaluated in. chain is the list of documents that include it.
+func (c *context) include(name string, chain []string) (*context, error) {
+	var (
+		f   io.ReadCloser
+		err error
+	)
+	if c.fsys != nil {
+		f, err = c.fsys.Open(name)
+	} else {
+		f, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tree, err := parse(f, name)
+	if err != nil {
+		return nil, err
+	}
+	inc := newContext()
+	inc.file = name
+	inc.fsys = c.fsys
+	inc.env = c.env
+	inc.funcs = c.funcs
+	inc.sandbox = c.sandbox
+	inc.profile = c.profile
+	inc.chain = chain
+	inc.docs = c.docs
+	if _, err := tree.eval(inc); err != nil {
+		return nil, err
+	}
+	return inc, nil
+}
+
+// ReadFS reads a moon object from the file with the given name within the
+// file system fsys. Any documents that it includes are read from fsys as
+// well.
+func ReadFS(fsys fs.FS, name string, opts ...Option) (*Object, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return read(f, name, append([]Option{withFS(fsys)}, opts...)...)
+}
@@ -0,0 +1,161 @@
+package moon
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadFSInclude(t *testing.T) {
+	fsys := fstest.MapFS{
+		"svc/main.moon": {Data: []byte(`
+			%include "../shared/logging.moon"
+			name: svc
+			log: @logging
+		`)},
+		"shared/logging.moon": {Data: []byte(`
+			%include tls.moon
+			@logging: {level: info; tls: @tls}
+			log_format: json
+		`)},
+		"shared/tls.moon": {Data: []byte("@tls: {cert: /etc/cert}\n")},
+	}
+
+	doc, err := ReadFS(fsys, "svc/main.moon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := doc.Keys(); !reflect.DeepEqual(keys, []string{"log_format", "name", "log"}) {
+		t.Errorf("bad keys: %v", keys)
+	}
+	var cert string
+	if err := doc.Get("log/tls/cert", &cert); err != nil || cert != "/etc/cert" {
+		t.Errorf("expected cert /etc/cert, saw %q (%v)", cert, err)
+	}
+	var format string
+	if err := doc.Get("log_format", &format); err != nil || format != "json" {
+		t.Errorf("expected log_format json, saw %q (%v)", format, err)
+	}
+}
+
+func TestIncludeDiamond(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.moon":   {Data: []byte("%include a.moon\n%include b.moon\n%include common.moon\n")},
+		"a.moon":      {Data: []byte("%include common.moon\na: {log: @log}\n")},
+		"b.moon":      {Data: []byte("%include common.moon\nb: {log: @log; level: @level}\n")},
+		"common.moon": {Data: []byte("@log: {format: json}\nlevel: info\n")},
+		"clash.moon":  {Data: []byte("%include a.moon\n%include other.moon\n")},
+		"other.moon":  {Data: []byte("level: debug\n")},
+	}
+
+	doc, err := ReadFS(fsys, "main.moon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := doc.Keys(); !reflect.DeepEqual(keys, []string{"level", "a", "b"}) {
+		t.Errorf("bad keys: %v", keys)
+	}
+	var format string
+	if err := doc.Get("b/log/format", &format); err != nil || format != "json" {
+		t.Errorf("expected format json, saw %q (%v)", format, err)
+	}
+
+	// a name that comes from two different documents is still an error
+	_, err = ReadFS(fsys, "clash.moon")
+	if err == nil || err.Error() != "clash.moon:2:1: invalid re-declaration: level (included from other.moon)" {
+		t.Errorf("expected a re-declaration error, saw %v", err)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"cycle_a.moon":   {Data: []byte("%include cycle_b.moon\n")},
+		"cycle_b.moon":   {Data: []byte("x: 1\n%include cycle_a.moon\n")},
+		"missing.moon":   {Data: []byte("%include nope.moon\n")},
+		"nested.moon":    {Data: []byte("%include missing.moon\n")},
+		"redeclare.moon": {Data: []byte("%include value.moon\nvalue: 2\n")},
+		"hidden.moon":    {Data: []byte("@value: 3\n%include value.moon\n")},
+		"value.moon":     {Data: []byte("value: 1\n")},
+		"bad.moon":       {Data: []byte("%include broken.moon\n")},
+		"broken.moon":    {Data: []byte("a: @undefined\n")},
+	}
+
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{"cycle_a.moon", "cycle_b.moon:2:1: include cycle: cycle_a.moon -> cycle_b.moon -> cycle_a.moon\n\tincluded from cycle_a.moon:1:1"},
+		{"nested.moon", "open nope.moon: file does not exist\n\tincluded from missing.moon:1:1\n\tincluded from nested.moon:1:1"},
+		{"redeclare.moon", "redeclare.moon:2:1: invalid re-declaration: value"},
+		{"hidden.moon", "hidden.moon:2:1: invalid re-declaration: value (included from value.moon)"},
+		{"bad.moon", "broken.moon:1:4: undefined variable: undefined\n\tincluded from bad.moon:1:1"},
+	}
+	for _, test := range tests {
+		_, err := ReadFS(fsys, test.name)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		if err.Error() != test.msg {
+			t.Errorf("%s: expected error\n%s\nsaw\n%s", test.name, test.msg, err)
+		}
+	}
+
+	_, err := ReadFS(fsys, "bad.moon")
+	var ie *IncludeError
+	if !errors.As(err, &ie) || ie.Path != "broken.moon" {
+		t.Errorf("expected an include error for broken.moon, saw %v", err)
+	}
+	var ee *EvalError
+	if !errors.As(err, &ee) || ee.Pos.Filename != "broken.moon" {
+		t.Errorf("expected an eval error in broken.moon, saw %v", err)
+	}
+}
+
+func TestReadFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.moon":           "%include conf/db.moon\nname: svc\n",
+		"conf/db.moon":        "%include pool.moon\ndb: {host: localhost; pool: @pool}\n",
+		"conf/pool.moon":      "@pool: {size: 10}\n",
+		"conf/selfcycle.moon": "%include \"./selfcycle.moon\"\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc, err := ReadFile(filepath.Join(dir, "main.moon"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	if err := doc.Get("db/pool/size", &size); err != nil || size != 10 {
+		t.Errorf("expected pool size 10, saw %d (%v)", size, err)
+	}
+
+	_, err = ReadFile(filepath.Join(dir, "conf", "selfcycle.moon"))
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("expected an include cycle, saw %v", err)
+	}
+
+	diags := CheckFile(filepath.Join(dir, "main.moon"))
+	if len(diags) != 0 {
+		t.Errorf("expected no diagnostics, saw %v", diags)
+	}
+}
@@ -3,12 +3,13 @@ package moon
 import (
 	"bufio"
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 const eof = -1
@@ -47,8 +48,26 @@ func (t tokenType) String() string {
 		return "t_bool"
 	case t_duration:
 		return "t_duration"
+	case t_directive:
+		return "t_directive"
+	case t_env:
+		return "t_env"
+	case t_template:
+		return "t_template"
+	case t_spread:
+		return "t_spread"
+	case t_paren_open:
+		return "t_paren_open"
+	case t_paren_close:
+		return "t_paren_close"
+	case t_operator:
+		return "t_operator"
+	case t_null:
+		return "t_null"
+	case t_timestamp:
+		return "t_timestamp"
 	default:
-		panic(fmt.Sprintf("unknown token type: %v", t))
+		panic(fmt.Sprintf("unknown token type: %d", int(t)))
 	}
 }
 
@@ -57,6 +76,7 @@ const (
 	t_eof                               // end of file token
 	t_string                            // a bare string
 	t_string_quoted                     // a quoted string
+	t_string_raw                        // a raw string, in backticks
 	t_name                              // a name
 	t_comment                           // a comment
 	t_list_start                        // [
@@ -69,34 +89,106 @@ const (
 	t_variable                          // e.g. @var_name, a variable name.
 	t_bool                              // a boolean token (true|false)
 	t_duration                          // a duration (e.g.: 1s, 2h45m, 900ms)
+	t_directive                         // a directive (e.g.: %include), named without its %
+	t_env                               // an environment variable reference (e.g.: ${HOME}), without its ${ and }
+	t_template                          // a quoted string or heredoc that interpolates variables (e.g.: "@{host}:@{port}")
+	t_spread                            // the spread operator, ..., which splices an object or list into another
+	t_paren_open                        // an opening parenthesis, which starts an expression
+	t_paren_close                       // a closing parenthesis
+	t_operator                          // an operator within an expression (e.g.: + or <=), or the comma between arguments
+	t_null                              // the null value, which explicitly leaves a value unset
+	t_timestamp                         // an RFC 3339 date or timestamp (e.g.: 2024-05-01, 2024-05-01T09:30:00Z)
 )
 
 type stateFn func(*lexer) stateFn
 
 type token struct {
-	t tokenType
-	s string
+	t   tokenType
+	s   string
+	pos Position
+	end int // byte offset just past the end of the token's source text
 }
 
 func (t token) String() string {
 	return fmt.Sprintf("{%s %s}", t.t, t.s)
 }
 
+// lexer is a pull-based lexer. Each call to nextToken runs the lexer's state
+// functions just far enough to produce one more token, so the lexer does no
+// work (and holds on to nothing) beyond what its caller asks of it.
 type lexer struct {
 	in     io.RuneReader
-	out    chan token
-	buf    []rune // running buffer for current lexeme
+	state  stateFn // state function to run to produce more tokens
+	queue  []token // tokens emitted but not yet handed out by nextToken
+	buf    []rune  // running buffer for current lexeme
 	backup []rune
 	err    error
+	name   string // file name used when reporting positions
+	offset int    // byte offset of the next rune to be read
+	start  int    // byte offset at which the current lexeme started
+	lines  []int  // byte offsets at which each line starts
+	depth  int    // how many parentheses are open; expressions are lexed while positive
+	lists  []bool // for each open list or object, whether it's a list
+	value  bool   // whether the next token is a value rather than the start of an assignment
+
+	escaped []int // indexes in buf of the runes of a quoted string that were written as escapes
 }
 
-func (l *lexer) lex() {
-	defer close(l.out)
-	for fn := lexRoot; fn != nil; {
-		fn = fn(l)
+// nextToken returns the next token in the input. Once the input is exhausted,
+// every call to nextToken returns a t_eof token.
+func (l *lexer) nextToken() token {
+	for len(l.queue) == 0 {
+		if l.state == nil {
+			return token{t_eof, "eof", l.position(l.offset), l.offset}
+		}
+		l.state = l.state(l)
 		if l.err != nil {
-			fn = lexErrorf("read error: %s", l.err)
+			l.push(token{t_error, fmt.Sprintf("read error: %s", l.err), l.position(l.offset), l.offset})
+			l.state = nil
+		}
+	}
+	t := l.queue[0]
+	n := copy(l.queue, l.queue[1:])
+	l.queue = l.queue[:n]
+	return t
+}
+
+func (l *lexer) push(t token) {
+	l.queue = append(l.queue, t)
+	l.track(t.t)
+}
+
+// track follows the nesting of lists and objects just closely enough to know
+// whether the next token is a value, as it is after a colon or inside a list,
+// or begins an assignment.
+func (l *lexer) track(t tokenType) {
+	inList := func() bool { return len(l.lists) > 0 && l.lists[len(l.lists)-1] }
+	switch t {
+	case t_comment, t_error:
+	case t_object_separator:
+		l.value = true
+	case t_list_start, t_object_start:
+		l.lists = append(l.lists, t == t_list_start)
+		l.value = inList()
+	case t_list_end, t_object_end:
+		if len(l.lists) > 0 {
+			l.lists = l.lists[:len(l.lists)-1]
 		}
+		l.value = inList()
+	default:
+		l.value = inList()
+	}
+}
+
+// position translates a byte offset into a full Position. Only offsets that
+// the lexer has already read past may be translated.
+func (l *lexer) position(offset int) Position {
+	line := sort.Search(len(l.lines), func(i int) bool { return l.lines[i] > offset })
+	return Position{
+		Filename: l.name,
+		Offset:   offset,
+		Line:     line,
+		Column:   offset - l.lines[line-1] + 1,
 	}
 }
 
@@ -104,6 +196,7 @@ func (l *lexer) next() rune {
 	if len(l.backup) > 0 {
 		r := l.backup[len(l.backup)-1]
 		l.backup = l.backup[:len(l.backup)-1]
+		l.offset += runeWidth(r)
 		return r
 	}
 	r, _, err := l.in.ReadRune()
@@ -111,12 +204,15 @@ func (l *lexer) next() rune {
 	case io.EOF:
 		return eof
 	case nil:
+		l.offset += runeWidth(r)
+		if r == '\n' {
+			l.lines = append(l.lines, l.offset)
+		}
 		return r
 	default:
 		l.err = err
 		return eof
 	}
-	return r
 }
 
 func (l *lexer) peek() rune {
@@ -134,6 +230,20 @@ func (l *lexer) keep(r rune) {
 
 func (l *lexer) unread(r rune) {
 	l.backup = append(l.backup, r)
+	l.offset -= runeWidth(r)
+}
+
+// runeWidth is the number of bytes that r occupied in the source. Invalid
+// UTF-8 is read as utf8.RuneError, one byte at a time.
+func runeWidth(r rune) int {
+	switch r {
+	case eof:
+		return 0
+	case utf8.RuneError:
+		return 1
+	default:
+		return utf8.RuneLen(r)
+	}
 }
 
 func (l *lexer) emit(t tokenType) {
@@ -143,25 +253,38 @@ func (l *lexer) emit(t tokenType) {
 			break
 		}
 		msg := fmt.Sprintf(`invalid var name: "%s" (var names cannot contain spaces)`, string(l.buf))
-		l.out <- token{t_error, msg}
+		l.push(token{t_error, msg, l.position(l.start), l.offset})
+		l.buf = l.buf[0:0]
 		return
 	case t_name:
 		if !l.bufHasSpaces() {
 			break
 		}
 		msg := fmt.Sprintf(`invalid name: "%s" (names cannot contain spaces)`, string(l.buf))
-		l.out <- token{t_error, msg}
+		l.push(token{t_error, msg, l.position(l.start), l.offset})
+		l.buf = l.buf[0:0]
 		return
 	case t_string:
 		switch string(l.buf) {
 		case "true", "false":
 			t = t_bool
+		case "null":
+			t = t_null
 		}
 	case t_string_quoted:
+		var s string
+		t, s = quotedString(l.buf, l.escaped)
+		l.push(token{t, s, l.position(l.start), l.offset})
+		l.buf = l.buf[0:0]
+		l.escaped = l.escaped[0:0]
+		l.start = l.offset
+		return
+	case t_string_raw:
 		t = t_string
 	}
-	l.out <- token{t, string(l.buf)}
+	l.push(token{t, string(l.buf), l.position(l.start), l.offset})
 	l.buf = l.buf[0:0]
+	l.start = l.offset
 }
 
 func (l *lexer) accept(chars string) bool {
@@ -192,50 +315,67 @@ func (l *lexer) bufHasSpaces() bool {
 	return false
 }
 
-func lexString(in string) chan token {
+func lexString(in string) *lexer {
 	r := strings.NewReader(in)
-	return lex(r)
+	return lex(r, "")
 }
 
-func lex(r io.Reader) chan token {
-	l := lexer{
+func lex(r io.Reader, name string) *lexer {
+	return &lexer{
 		in:     bufio.NewReader(r),
-		out:    make(chan token),
+		state:  lexRoot,
+		queue:  make([]token, 0, 2),
 		backup: make([]rune, 0, 4),
+		name:   name,
+		lines:  []int{0},
 	}
-	go l.lex()
-	return l.out
 }
 
-func fullTokens(c chan token) ([]token, error) {
+func fullTokens(l *lexer) ([]token, error) {
 	tokens := make([]token, 0, 32)
-	for t := range c {
+	for t := l.nextToken(); t.t != t_eof; t = l.nextToken() {
 		if t.t == t_error {
-			return nil, errors.New(t.s)
+			return nil, syntaxErrorf(t.pos, "%s", t.s)
 		}
 		tokens = append(tokens, t)
 	}
 	return tokens, nil
 }
 
+// lexErrorf emits an error token and then resumes lexing at the root state,
+// so that a parser that is recovering from errors may continue past it.
 func lexErrorf(t string, args ...interface{}) stateFn {
 	return func(l *lexer) stateFn {
-		l.out <- token{t_error, fmt.Sprintf(t, args...)}
-		return nil
+		l.push(token{t_error, fmt.Sprintf(t, args...), l.position(l.offset), l.offset})
+		l.buf = l.buf[0:0]
+		return lexRoot
 	}
 }
 
 func lexRoot(l *lexer) stateFn {
+	if l.depth > 0 {
+		return lexExpr
+	}
+	l.start = l.offset
 	r := l.next()
 	switch {
 	case r == eof:
 		return nil
+	case r == '(':
+		l.keep(r)
+		l.emit(t_paren_open)
+		l.depth++
+		return lexExpr
 	case r == ':':
 		l.keep(r)
 		l.emit(t_object_separator)
 		return lexRoot
-	case r == '"', r == '`':
+	case r == ';':
+		return lexRoot
+	case r == '"', r == '\'':
 		return lexQuotedString(r)
+	case r == '`':
+		return lexRawString
 	case r == '#':
 		return lexComment
 	case r == '[':
@@ -269,6 +409,11 @@ func lexRoot(l *lexer) stateFn {
 		fallthrough
 	case r == '@':
 		return lexVariable
+	case r == '%' && l.directive():
+		return lexDirective
+	case r == '$' && l.peek() == '{':
+		l.next()
+		return lexEnv
 	case strings.IndexRune("+-0123456789", r) >= 0:
 		l.unread(r)
 		return lexNumber
@@ -285,6 +430,11 @@ func lexRoot(l *lexer) stateFn {
 func lexAfterPeriod(l *lexer) stateFn {
 	r := l.next()
 	switch {
+	case r == '.' && l.peek() == '.':
+		l.keep(r)
+		l.keep(l.next())
+		l.emit(t_spread)
+		return lexRoot
 	case strings.IndexRune("+-0123456789", r) >= 0:
 		l.unread(r)
 		return lexNumber
@@ -299,6 +449,7 @@ func lexAfterPeriod(l *lexer) stateFn {
 func lexComment(l *lexer) stateFn {
 	switch r := l.next(); r {
 	case '\n':
+		l.unread(r)
 		l.emit(t_comment)
 		return lexRoot
 	case eof:
@@ -317,13 +468,12 @@ func lexQuotedString(delim rune) stateFn {
 			l.emit(t_string_quoted)
 			return lexRoot
 		case '\\':
-			switch r := l.next(); r {
-			case eof:
-				return lexErrorf("unexpected eof in string literal")
-			default:
-				l.keep(r)
-				return lexQuotedString(delim)
+			start := l.offset - 1
+			if err := l.escape(); err != "" {
+				return lexBadString(delim, start, err)
 			}
+			l.escaped = append(l.escaped, len(l.buf)-1)
+			return lexQuotedString(delim)
 		case eof:
 			return lexErrorf("unexpected eof in string literal")
 		default:
@@ -333,20 +483,125 @@ func lexQuotedString(delim rune) stateFn {
 	}
 }
 
+// escape lexes the escape sequence that follows a backslash in a quoted
+// string, keeping the character that it stands for. The escapes are those of
+// Go: \a \b \f \n \r \t \v \\ \' \" and the numeric escapes \xNN,
+// \uNNNN and \UNNNNNNNN, each of which gives the Unicode code point with the
+// given hexadecimal value. Since a string is a sequence of code points rather
+// than of bytes, \xNN stands for U+00NN. escape gives a description of what's
+// wrong with an invalid escape sequence.
+func (l *lexer) escape() string {
+	r := l.next()
+	switch r {
+	case 'a':
+		l.keep('\a')
+	case 'b':
+		l.keep('\b')
+	case 'f':
+		l.keep('\f')
+	case 'n':
+		l.keep('\n')
+	case 'r':
+		l.keep('\r')
+	case 't':
+		l.keep('\t')
+	case 'v':
+		l.keep('\v')
+	case '\\', '\'', '"':
+		l.keep(r)
+	case 'x', 'u', 'U':
+		n := 2
+		switch r {
+		case 'u':
+			n = 4
+		case 'U':
+			n = 8
+		}
+		var v rune
+		for i := 0; i < n; i++ {
+			d := l.next()
+			x, ok := unhex(d)
+			if !ok {
+				l.unread(d)
+				return fmt.Sprintf(`invalid escape sequence: \%c must be followed by %d hexadecimal digits`, r, n)
+			}
+			v = v<<4 | x
+		}
+		if !utf8.ValidRune(v) {
+			return fmt.Sprintf(`invalid escape sequence: U+%04X is not a valid Unicode code point`, v)
+		}
+		l.keep(v)
+	case eof:
+		return "unexpected eof in string literal"
+	default:
+		if r == '\n' {
+			l.unread(r)
+		}
+		return fmt.Sprintf(`unknown escape sequence: \%c`, r)
+	}
+	return ""
+}
+
+func unhex(r rune) (rune, bool) {
+	switch {
+	case '0' <= r && r <= '9':
+		return r - '0', true
+	case 'a' <= r && r <= 'f':
+		return r - 'a' + 10, true
+	case 'A' <= r && r <= 'F':
+		return r - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// lexBadString skips the rest of a quoted string that contains an invalid
+// escape sequence, and then reports the escape sequence at start.
+func lexBadString(delim rune, start int, msg string) stateFn {
+	return func(l *lexer) stateFn {
+		for {
+			switch r := l.next(); r {
+			case '\\':
+				l.next()
+			case delim, eof:
+				l.push(token{t_error, msg, l.position(start), l.offset})
+				l.buf = l.buf[0:0]
+				l.escaped = l.escaped[0:0]
+				return lexRoot
+			}
+		}
+	}
+}
+
+// lexRawString lexes a raw string, which is enclosed in backticks and taken
+// exactly as it's written: it has no escape sequences and doesn't interpolate
+// variables, and so can't contain a backtick.
+func lexRawString(l *lexer) stateFn {
+	switch r := l.next(); r {
+	case '`':
+		l.emit(t_string_raw)
+		return lexRoot
+	case eof:
+		return lexErrorf("unexpected eof in raw string literal")
+	default:
+		l.keep(r)
+		return lexRawString
+	}
+}
+
 func lexNameOrString(l *lexer) stateFn {
 	r := l.next()
 	switch {
 	case r == '\n', r == ';':
+		l.unread(r)
 		l.emit(t_string)
 		return lexRoot
 	case r == ':':
+		l.unread(r)
 		l.emit(t_name)
-		l.keep(r)
-		l.emit(t_object_separator)
 		return lexRoot
 	case isSpecial(r):
-		l.emit(t_string)
 		l.unread(r)
+		l.emit(t_string)
 		return lexRoot
 	case r == '\\':
 		rr := l.next()
@@ -370,6 +625,7 @@ func lexVariable(l *lexer) stateFn {
 	r := l.next()
 	switch {
 	case unicode.IsSpace(r), r == ';':
+		l.unread(r)
 		l.emit(t_variable)
 		return lexRoot
 	case r == '\\':
@@ -380,8 +636,8 @@ func lexVariable(l *lexer) stateFn {
 		l.keep(rr)
 		return lexVariable
 	case isSpecial(r):
-		l.emit(t_variable)
 		l.unread(r)
+		l.emit(t_variable)
 		return lexRoot
 	case r == eof:
 		l.emit(t_variable)
@@ -394,7 +650,69 @@ func lexVariable(l *lexer) stateFn {
 	}
 }
 
+// directive determines whether the % just read begins a directive. %profile
+// is a directive wherever a value or an assignment may begin, and %include
+// only where an assignment may begin; anywhere else, and for any other name,
+// the % begins a bare string, such as the %s in "format: %s".
+func (l *lexer) directive() bool {
+	var read []rune
+	defer func() {
+		for i := len(read) - 1; i >= 0; i-- {
+			l.unread(read[i])
+		}
+	}()
+	for {
+		r := l.next()
+		read = append(read, r)
+		if !unicode.IsLetter(r) {
+			break
+		}
+	}
+	if end := read[len(read)-1]; end != eof && !unicode.IsSpace(end) && end != '{' {
+		return false
+	}
+	switch string(read[:len(read)-1]) {
+	case "profile":
+		return true
+	case "include":
+		return !l.value
+	}
+	return false
+}
+
+func lexDirective(l *lexer) stateFn {
+	r := l.next()
+	switch {
+	case unicode.IsLetter(r):
+		l.keep(r)
+		return lexDirective
+	case len(l.buf) == 0:
+		return lexErrorf("expected directive name after %%, saw %q", r)
+	default:
+		l.unread(r)
+		l.emit(t_directive)
+		return lexRoot
+	}
+}
+
+func lexEnv(l *lexer) stateFn {
+	switch r := l.next(); r {
+	case '}':
+		l.emit(t_env)
+		return lexRoot
+	case '\n', eof:
+		l.unread(r)
+		return lexErrorf("unterminated environment variable reference: ${%s", string(l.buf))
+	default:
+		l.keep(r)
+		return lexEnv
+	}
+}
+
 func lexNumber(l *lexer) stateFn {
+	if l.timestamp() {
+		return lexRoot
+	}
 	l.accept("+-")
 	digits := "0123456789"
 	if l.accept("0") {
@@ -427,10 +745,72 @@ func lexNumber(l *lexer) stateFn {
 	return lexRoot
 }
 
+// timestamp lexes a date or a timestamp, if one begins at the current
+// position. Anything that begins with a date, such as 2024-05-01, is taken to
+// be a timestamp, and whatever follows the date up to the next character that
+// can't appear in a timestamp is part of it. timestamp reports whether it found
+// a timestamp, and leaves the input as it was if it didn't.
+func (l *lexer) timestamp() bool {
+	const layout = "0000-00-00"
+	seen := make([]rune, 0, len(layout))
+	for _, c := range layout {
+		r := l.next()
+		seen = append(seen, r)
+		if c == '0' && !unicode.IsDigit(r) || c == '-' && r != '-' {
+			for i := len(seen) - 1; i >= 0; i-- {
+				l.unread(seen[i])
+			}
+			return false
+		}
+	}
+	l.buf = append(l.buf, seen...)
+	for {
+		r := l.next()
+		if !isAlphaNumeric(r) && !strings.ContainsRune("-:+.", r) {
+			l.unread(r)
+			break
+		}
+		l.keep(r)
+	}
+	if _, err := parseTime(string(l.buf)); err != nil {
+		l.push(token{t_error, err.Error(), l.position(l.start), l.offset})
+		l.buf = l.buf[0:0]
+		l.start = l.offset
+		return true
+	}
+	l.emit(t_timestamp)
+	return true
+}
+
+// parseTime parses a date or timestamp. Timestamps are written as described
+// by RFC 3339, and must have a time zone offset. A date on its own is midnight
+// UTC at the start of that date.
+func parseTime(s string) (time.Time, error) {
+	u := strings.ToUpper(s)
+	if len(u) == len("2006-01-02") {
+		if t, err := time.Parse("2006-01-02", u); err == nil {
+			return t, nil
+		}
+	} else if t, err := time.Parse(time.RFC3339Nano, u); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp: %s (expected an RFC 3339 date, such as 2006-01-02, or timestamp, such as 2006-01-02T15:04:05Z)", s)
+}
+
+// formatTime formats a time the way parseTime reads it: as a date if it's
+// midnight UTC, and as an RFC 3339 timestamp otherwise.
+func formatTime(t time.Time) string {
+	if t.Location() == time.UTC && t.Equal(t.Truncate(24*time.Hour)) {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
 func lexDuration(l *lexer) stateFn {
 	r := l.next()
 	switch {
 	case r == '\n', r == ';':
+		l.unread(r)
 		_, err := time.ParseDuration(string(l.buf))
 		if err == nil {
 			l.emit(t_duration)
@@ -441,29 +821,29 @@ func lexDuration(l *lexer) stateFn {
 	case unicode.IsSpace(r):
 		_, err := time.ParseDuration(string(l.buf))
 		if err == nil {
+			l.unread(r)
 			l.emit(t_duration)
 			return lexRoot
 		}
 		l.keep(r)
 		return lexNameOrString
 	case r == ':':
+		l.unread(r)
 		_, err := time.ParseDuration(string(l.buf))
 		if err == nil {
 			l.emit(t_duration)
 		} else {
 			l.emit(t_name)
 		}
-		l.keep(r)
-		l.emit(t_object_separator)
 		return lexRoot
 	case isSpecial(r):
+		l.unread(r)
 		_, err := time.ParseDuration(string(l.buf))
 		if err == nil {
 			l.emit(t_duration)
 		} else {
 			l.emit(t_string)
 		}
-		l.unread(r)
 		return lexRoot
 	case r == '\\':
 		l.unread(r)
@@ -484,43 +864,77 @@ func lexDuration(l *lexer) stateFn {
 	}
 }
 
+// heredoc describes the form of a heredoc, as given by its opening line.
+type heredoc struct {
+	label       string
+	indented    bool // <<~LABEL: the terminator may be indented, and common indentation is removed
+	interpolate bool // <<@LABEL: @{name} references are interpolated, as in a quoted string
+	chomp       bool // <<LABEL-: the final newline is removed
+}
+
+// lexHeredocStart lexes the opening line of a heredoc, following its <<. The
+// label is made of letters, digits and underscores, and may be preceded by a
+// ~, for an indented heredoc, then by an @, for a heredoc that interpolates
+// references, and followed by a -, to remove the heredoc's final newline.
 func lexHeredocStart(l *lexer) stateFn {
-	r := l.next()
-	switch {
-	case r == '\n':
-		if len(l.buf) == 0 {
-			return lexErrorf("illegal zero-width heredoc name")
+	var h heredoc
+	if l.peek() == '~' {
+		l.next()
+		h.indented = true
+	}
+	if l.peek() == '@' {
+		l.next()
+		h.interpolate = true
+	}
+	for {
+		r := l.next()
+		switch {
+		case r == '\n':
+			if len(l.buf) == 0 {
+				return lexErrorf("illegal zero-width heredoc name")
+			}
+			h.label = string(l.buf)
+			l.buf = l.buf[0:0]
+			return lexHeredocBody(h)
+		case r == '-' && len(l.buf) > 0 && !h.chomp && l.peek() == '\n':
+			h.chomp = true
+		case r == '_' || unicode.IsLetter(r) || (unicode.IsDigit(r) && len(l.buf) > 0):
+			l.keep(r)
+		case r == eof:
+			return lexErrorf("unexpected EOF in lexHeredocStart")
+		default:
+			return lexErrorf("unexpected rune in lexHeredocStart: %c (heredoc labels are made of letters, digits and underscores)", r)
 		}
-		label := string(l.buf)
-		l.buf = l.buf[0:0]
-		return lexHeredocBody(label)
-	case unicode.IsUpper(r):
-		l.keep(r)
-		return lexHeredocStart
-	case r == eof:
-		return lexErrorf("unexpected EOF in lexHeredocStart")
-	default:
-		return lexErrorf("unexpected rune in lexHeredocStart: %c (only uppercase letters are ok here)", r)
 	}
 }
 
-func lexHeredocBody(label string) stateFn {
-	var body bytes.Buffer
+func lexHeredocBody(h heredoc) stateFn {
+	var lines []string
 	line := make([]rune, 0, 128)
 	return func(l *lexer) stateFn {
 		for {
 			r := l.next()
 			switch r {
-			case '\n':
-				if string(line) == label {
-					l.out <- token{t_string, string(body.Bytes())}
+			case '\n', eof:
+				end := string(line)
+				if h.indented {
+					end = strings.TrimLeft(end, " \t")
+				}
+				if end == h.label {
+					l.unread(r)
+					body := h.body(lines)
+					t := t_string
+					if h.interpolate {
+						t = stringType(body)
+					}
+					l.push(token{t, body, l.position(l.start), l.offset})
 					return lexRoot
 				}
-				body.WriteString(string(line))
+				if r == eof {
+					return lexErrorf("unexpected eof inside of heredoc %s", h.label)
+				}
+				lines = append(lines, string(line))
 				line = line[0:0]
-				body.WriteRune(r)
-			case eof:
-				return lexErrorf("unexpected eof inside of heredoc %s", label)
 			default:
 				line = append(line, r)
 			}
@@ -528,6 +942,251 @@ func lexHeredocBody(label string) stateFn {
 	}
 }
 
+// body gives the contents of a heredoc made up of the given lines.
+func (h heredoc) body(lines []string) string {
+	if h.indented {
+		lines = dedent(lines)
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if h.chomp && buf.Len() > 0 {
+		buf.Truncate(buf.Len() - 1)
+	}
+	return buf.String()
+}
+
+// dedent removes the indentation that is common to every line that isn't
+// blank. Spaces and tabs are not interchangeable: the indentation removed is
+// the longest prefix of spaces and tabs shared by those lines. Blank lines are
+// emptied.
+func dedent(lines []string) []string {
+	prefix, first := "", true
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		indent := line[:len(line)-len(trimmed)]
+		if first {
+			prefix, first = indent, false
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		if strings.TrimLeft(line, " \t") != "" {
+			out[i] = line[len(prefix):]
+		}
+	}
+	return out
+}
+
+// stringType determines the token type of an interpolating heredoc with the
+// contents s: heredocs that interpolate variables are templates. Other
+// heredocs are taken verbatim, and are never templates.
+func stringType(s string) tokenType {
+	if strings.Contains(s, "@{") {
+		return t_template
+	}
+	return t_string
+}
+
+// quotedString determines the token type and text of a quoted string whose
+// decoded contents are buf. The runes at the indexes in escaped were written
+// as escape sequences, and an escaped rune is never part of a reference, so
+// "\x40{x}" is the literal text @{x}. Such an @{ is doubled in the text of a
+// template, as @@{, the form that a template takes to be literal.
+func quotedString(buf []rune, escaped []int) (tokenType, string) {
+	esc := make(map[int]bool, len(escaped))
+	for _, i := range escaped {
+		esc[i] = true
+	}
+	ref := func(i int) bool {
+		return buf[i] == '@' && i+1 < len(buf) && buf[i+1] == '{'
+	}
+
+	t := t_string
+	for i := range buf {
+		if ref(i) && !esc[i] && !esc[i+1] {
+			t = t_template
+			break
+		}
+	}
+	if t == t_string || len(escaped) == 0 {
+		return t, string(buf)
+	}
+
+	var b strings.Builder
+	for i, r := range buf {
+		if ref(i) && (esc[i] || esc[i+1]) {
+			b.WriteRune('@')
+		}
+		b.WriteRune(r)
+	}
+	return t, b.String()
+}
+
+// operators are the operators that may appear within an expression. Where
+// one operator is a prefix of another, the longer one comes first.
+var operators = []string{
+	"==", "!=", "<=", ">=", "&&", "||",
+	"+", "-", "*", "/", "%", "<", ">", "!", ",", "?", ":",
+}
+
+// lexExpr lexes the inside of a parenthesized expression. Within an
+// expression, whitespace (newlines included) only separates tokens and strings
+// must be quoted. A - or / that follows a variable is part of its name, so
+// subtraction and division need spaces around them, as in (@total / 2).
+// States that return to lexRoot come back here for as long as a parenthesis
+// is open.
+func lexExpr(l *lexer) stateFn {
+	l.start = l.offset
+	r := l.next()
+	switch {
+	case r == eof:
+		l.depth = 0
+		return lexErrorf("unexpected eof in expression: missing )")
+	case unicode.IsSpace(r):
+		return lexExpr
+	case r == '(':
+		l.keep(r)
+		l.emit(t_paren_open)
+		l.depth++
+		return lexExpr
+	case r == ')':
+		l.keep(r)
+		l.emit(t_paren_close)
+		l.depth--
+		return lexRoot
+	case r == '#':
+		return lexComment
+	case r == '"', r == '\'':
+		return lexQuotedString(r)
+	case r == '`':
+		return lexRawString
+	case r == '@':
+		return lexExprVariable
+	case r == '$' && l.peek() == '{':
+		l.next()
+		return lexEnv
+	case r == '.' && unicode.IsDigit(l.peek()), unicode.IsDigit(r):
+		l.unread(r)
+		if l.timestamp() {
+			return lexExpr
+		}
+		l.keep(l.next())
+		return lexExprNumber
+	case unicode.IsLetter(r), r == '_':
+		l.keep(r)
+		return lexExprWord
+	}
+	for _, op := range operators {
+		first, size := utf8.DecodeRuneInString(op)
+		if r != first {
+			continue
+		}
+		if len(op) > size {
+			if l.peek() != rune(op[size]) {
+				continue
+			}
+			l.next()
+		}
+		l.buf = append(l.buf, []rune(op)...)
+		l.emit(t_operator)
+		return lexExpr
+	}
+	switch r {
+	case '[':
+		return lexErrorf("unexpected rune in expression: [ (a list in an expression has to come from a variable or a function)")
+	case '{':
+		return lexErrorf("unexpected rune in expression: { (an object in an expression has to come from a variable or a function)")
+	}
+	return lexErrorf("unexpected rune in expression: %c", r)
+}
+
+// lexExprVariable lexes a variable within an expression, where it's ended by
+// whitespace, a parenthesis, or an operator other than - and /, which may
+// appear in names and paths.
+func lexExprVariable(l *lexer) stateFn {
+	r := l.next()
+	switch {
+	case r == '\\':
+		rr := l.next()
+		if rr == eof {
+			return lexErrorf("unexpected eof in variable name")
+		}
+		l.keep(rr)
+		return lexExprVariable
+	case unicode.IsPrint(r) && !unicode.IsSpace(r) && !isSpecial(r) && !strings.ContainsRune("()+*%<>=!&|,?", r):
+		l.keep(r)
+		return lexExprVariable
+	default:
+		l.unread(r)
+		if len(l.buf) == 0 {
+			return lexErrorf("expected variable name after @")
+		}
+		l.emit(t_variable)
+		return lexExpr
+	}
+}
+
+// lexExprNumber lexes a number or a duration within an expression. Signs are
+// operators in an expression; only the sign of an exponent belongs to the
+// number.
+func lexExprNumber(l *lexer) stateFn {
+	r := l.next()
+	switch {
+	case isAlphaNumeric(r), r == '.', r == 'µ':
+		l.keep(r)
+		return lexExprNumber
+	case (r == '+' || r == '-') && strings.ContainsRune("eE", l.buf[len(l.buf)-1]) && !strings.ContainsAny(string(l.buf), "xX"):
+		l.keep(r)
+		return lexExprNumber
+	}
+	l.unread(r)
+	s := string(l.buf)
+	switch {
+	case strings.HasSuffix(s, "i"):
+		l.emit(t_imaginary_number)
+	case strings.IndexFunc(s, unicode.IsLetter) >= 0 && isDuration(s):
+		l.emit(t_duration)
+	default:
+		l.emit(t_real_number)
+	}
+	return lexExpr
+}
+
+func isDuration(s string) bool {
+	_, err := time.ParseDuration(s)
+	return err == nil
+}
+
+// lexExprWord lexes a bare word within an expression: either true, false,
+// null, or the name of a function.
+func lexExprWord(l *lexer) stateFn {
+	r := l.next()
+	if isAlphaNumeric(r) {
+		l.keep(r)
+		return lexExprWord
+	}
+	l.unread(r)
+	switch string(l.buf) {
+	case "true", "false":
+		l.emit(t_bool)
+	case "null":
+		l.emit(t_null)
+	default:
+		l.emit(t_name)
+	}
+	return lexExpr
+}
+
 func isAlphaNumeric(r rune) bool {
 	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
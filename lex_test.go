@@ -33,8 +33,8 @@ func runLexTest(t *testing.T, basepath, inpath, outpath string) {
 	}
 
 	var buf bytes.Buffer
-	c := lex(in)
-	for t := range c {
+	l := lex(in, inpath)
+	for t := l.nextToken(); t.t != t_eof; t = l.nextToken() {
 		fmt.Fprintln(&buf, t)
 	}
 
@@ -57,3 +57,57 @@ func TestLex(t *testing.T) {
 		runLexTest(t, "tests/lex/", fname, strings.Replace(fname, "in", "out", -1))
 	}
 }
+
+// lexChannel hands tokens from l over an unbuffered channel, the way that the
+// lexer used to deliver them before it was pull-based. It's only used as a
+// baseline in benchmarks.
+func lexChannel(l *lexer) chan token {
+	c := make(chan token)
+	go func() {
+		defer close(c)
+		for t := l.nextToken(); t.t != t_eof; t = l.nextToken() {
+			c <- t
+		}
+	}()
+	return c
+}
+
+func benchmarkSource(b *testing.B) []byte {
+	src, err := ioutil.ReadFile("ex.moon")
+	if err != nil {
+		b.Fatalf("unable to read benchmark source: %s", err)
+	}
+	return src
+}
+
+func BenchmarkLex(b *testing.B) {
+	src := benchmarkSource(b)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := lex(bytes.NewReader(src), "")
+		for t := l.nextToken(); t.t != t_eof; t = l.nextToken() {
+		}
+	}
+}
+
+func BenchmarkLexChannel(b *testing.B) {
+	src := benchmarkSource(b)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for range lexChannel(lex(bytes.NewReader(src), "")) {
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	src := benchmarkSource(b)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadBytes(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -7,32 +7,24 @@ import (
 
 type List []interface{}
 
-func (l List) fillValue(v reflect.Value) error {
+// fillValue fills the destination value v with the contents of the list. path
+// is the location of the list within the document, and is used for error
+// reporting.
+func (l List) fillValue(v reflect.Value, path string) error {
 	if v.Kind() != reflect.Slice {
-		return fmt.Errorf("moon List can only fillValue to a slice, saw %v (%v)", v.Type(), v.Kind())
+		return &TypeError{
+			Path:     path,
+			Expected: v.Type(),
+			Actual:   reflect.TypeOf(l),
+			Err:      fmt.Errorf("moon List can only fillValue to a slice, saw %v (%v)", v.Type(), v.Kind()),
+		}
 	}
-	if v.IsNil() {
-		v.Set(reflect.MakeSlice(v.Type(), len(l), cap(l)))
+	if v.IsNil() || v.Len() != len(l) {
+		v.Set(reflect.MakeSlice(v.Type(), len(l), len(l)))
 	}
+	var diags Diagnostics
 	for idx, item := range l {
-		dv := v.Index(idx)
-
-		switch t_sv := item.(type) {
-		case *Object:
-			if err := t_sv.fillValue(dv); err != nil {
-				return err
-			}
-		case List:
-			if err := t_sv.fillValue(dv); err != nil {
-				return err
-			}
-		default:
-			sv := reflect.ValueOf(item)
-			if !sv.Type().AssignableTo(dv.Type()) {
-				return fmt.Errorf("unable to assign element %d: source type %v is not assignable to destination type %v", idx, sv.Type(), dv.Type())
-			}
-			dv.Set(sv)
-		}
+		diags.add(decodeValue(item, v.Index(idx), joinPath(path, idx)))
 	}
-	return nil
+	return diags.Err()
 }
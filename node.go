@@ -5,6 +5,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -25,21 +28,74 @@ const (
 	n_variable
 	n_bool
 	n_duration
+	n_include
+	n_env
+	n_template
+	n_spread
+	n_expr
+	n_binary
+	n_unary
+	n_call
+	n_cond
+	n_profile
+	n_null
+	n_time
 )
 
 var indent = "  "
 
 type context struct {
-	public  map[string]interface{}
+	public  *Object // exported values, in the order they were defined
 	private map[string]interface{}
+	bad     map[string]bool             // names whose values failed to evaluate
+	recover bool                        // whether to keep evaluating after an error
+	diags   Diagnostics                 // errors seen while recovering
+	file    string                      // name of the document being evaluated, used to resolve includes
+	fsys    fs.FS                       // file system that includes are read from; nil for the OS's
+	env     func(string) (string, bool) // looks up environment variables; nil if lookups are disabled
+	chain   []string                    // names of the documents that include this one, outermost first
+	funcs   Funcs                       // functions registered by the host program
+	sandbox bool                        // whether functions that read files are disabled
+	profile string                      // name of the profile selected by %profile values, if any
+	docs    map[string]*context         // included documents that have been evaluated, by name
+	from    map[string]string           // names of included values, mapped to the document that defined them
 }
 
 func newContext() *context {
-	return &context{make(map[string]interface{}), make(map[string]interface{})}
+	return &context{
+		public:  newObject(),
+		private: make(map[string]interface{}),
+		bad:     make(map[string]bool),
+		env:     os.LookupEnv,
+	}
+}
+
+// newDocContext creates the context in which the top-level document named
+// filename is evaluated.
+func newDocContext(filename string, opts []Option) *context {
+	ctx := newContext()
+	for _, opt := range opts {
+		opt(ctx)
+	}
+	if filename != "" && ctx.fsys == nil {
+		filename = filepath.Clean(filename)
+	}
+	ctx.file = filename
+	return ctx
+}
+
+// report records an evaluation error. If the context is not recovering from
+// errors, the error is handed back to the caller to be returned.
+func (c *context) report(err error) error {
+	if !c.recover {
+		return err
+	}
+	c.diags.add(err)
+	return nil
 }
 
 func (c *context) get(name string) (interface{}, bool) {
-	if v, ok := c.public[name]; ok {
+	if v, ok := c.public.items[name]; ok {
 		return v, true
 	}
 	if v, ok := c.private[name]; ok {
@@ -48,14 +104,50 @@ func (c *context) get(name string) (interface{}, bool) {
 	return nil, false
 }
 
+// lookup resolves a reference to a previously assigned value. The path is the
+// name of a public or hidden value, optionally followed by a path within that
+// value, as given to Object.Get: server/port, or servers/0/port.
+//
+// A name that itself contains a slash, as in @a/b: 1, is found before any path
+// is considered, so that such documents keep their meaning.
+func (c *context) lookup(pos Position, path string) (interface{}, error) {
+	if v, ok := c.get(path); ok {
+		return v, nil
+	}
+	parts := strings.Split(path, "/")
+	name := parts[0]
+	if c.bad[name] {
+		return nil, errBad
+	}
+	v, ok := c.get(name)
+	if !ok {
+		return nil, &EvalError{Pos: pos, Name: name, Msg: fmt.Sprintf("undefined variable: %s", name), undefined: true}
+	}
+	if len(parts) == 1 {
+		return v, nil
+	}
+	v, _, err := seek(path, parts[1:], v, Position{})
+	if err != nil {
+		_, missing := err.(NoValue)
+		if e, ok := err.(*TypeError); ok {
+			// there's nothing being assigned here; the cause says it all
+			err = e.Err
+		}
+		return nil, &EvalError{Pos: pos, Name: name, Msg: fmt.Sprintf("unable to resolve %s", path), Err: err, undefined: missing}
+	}
+	return v, nil
+}
+
 type node interface {
 	Type() nodeType
+	Pos() Position
 	parse(*parser) error
 	pretty(io.Writer, string) error
 	eval(*context) (interface{}, error)
 }
 
 type rootNode struct {
+	pos      Position
 	children []node
 }
 
@@ -67,30 +159,48 @@ func (n *rootNode) Type() nodeType {
 	return n_root
 }
 
+func (n *rootNode) Pos() Position {
+	return n.pos
+}
+
 func (n *rootNode) parse(p *parser) error {
+	n.pos = p.peek().pos
 	for {
 		t := p.next()
 		switch t.t {
 		case t_error:
-			return fmt.Errorf("parse error: saw lex error while parsing root node: %v", t)
+			if err := p.report(syntaxErrorf(t.pos, "parse error: saw lex error while parsing root node: %v", t.s)); err != nil {
+				return err
+			}
 		case t_eof:
 			return nil
 		case t_comment:
-			n.addChild(&commentNode{t.s})
-		case t_name:
-			nn := &assignmentNode{name: t.s}
-			if err := nn.parse(p); err != nil {
-				return err
+			n.addChild(&commentNode{pos: t.pos, body: t.s})
+		case t_directive:
+			nn, err := parseDirective(p, t)
+			if err != nil {
+				if err := p.report(err); err != nil {
+					return err
+				}
+				p.sync(t_eof)
+				continue
 			}
 			n.addChild(nn)
-		case t_variable:
-			nn := &assignmentNode{name: t.s, unexported: true}
+		case t_name, t_variable:
+			nn := &assignmentNode{pos: t.pos, name: t.s, unexported: t.t == t_variable}
 			if err := nn.parse(p); err != nil {
-				return err
+				if err := p.report(err); err != nil {
+					return err
+				}
+				nn.value = &badNode{pos: t.pos}
+				p.sync(t_eof)
 			}
 			n.addChild(nn)
 		default:
-			return fmt.Errorf("parse error: unexpected token type %v while parsing root node", t.t)
+			if err := p.report(syntaxErrorf(t.pos, "parse error: unexpected token type %v while parsing root node", t.t)); err != nil {
+				return err
+			}
+			p.sync(t_eof)
 		}
 	}
 }
@@ -128,13 +238,16 @@ func (n *rootNode) pretty(w io.Writer, prefix string) error {
 func (n *rootNode) eval(ctx *context) (interface{}, error) {
 	for _, child := range n.children {
 		if _, err := child.eval(ctx); err != nil {
-			return nil, err
+			if err := ctx.report(err); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return nil, nil
 }
 
 type commentNode struct {
+	pos  Position
 	body string
 }
 
@@ -142,6 +255,10 @@ func (n *commentNode) Type() nodeType {
 	return n_comment
 }
 
+func (n *commentNode) Pos() Position {
+	return n.pos
+}
+
 func (n *commentNode) parse(p *parser) error {
 	return nil
 }
@@ -174,6 +291,7 @@ func (n *commentNode) eval(ctx *context) (interface{}, error) {
 }
 
 type assignmentNode struct {
+	pos        Position
 	name       string
 	value      node
 	unexported bool
@@ -183,16 +301,20 @@ func (n *assignmentNode) Type() nodeType {
 	return n_assignment
 }
 
+func (n *assignmentNode) Pos() Position {
+	return n.pos
+}
+
 func (n *assignmentNode) parse(p *parser) error {
 	t := p.next()
 	switch t.t {
 	case t_error:
-		return fmt.Errorf("parse error: saw lex error while parsing assignment node: %v", t.s)
+		return syntaxErrorf(t.pos, "parse error: saw lex error while parsing assignment node: %v", t.s)
 	case t_eof:
-		return fmt.Errorf("parse error: unexpected eof in assignment node")
+		return syntaxErrorf(t.pos, "parse error: unexpected eof in assignment node")
 	case t_object_separator:
 	default:
-		return fmt.Errorf("parse error: unexpected %v token after name, expected =", t.t)
+		return syntaxErrorf(t.pos, "parse error: unexpected %v token after name, expected :", t.t)
 	}
 
 	v, err := p.parseValue()
@@ -220,16 +342,17 @@ func (n *assignmentNode) pretty(w io.Writer, prefix string) error {
 
 func (n *assignmentNode) eval(ctx *context) (interface{}, error) {
 	if _, ok := ctx.get(n.name); ok {
-		return nil, fmt.Errorf("invalid re-declaration: %s", n.name)
+		return nil, evalErrorf(n.pos, n.name, "invalid re-declaration: %s", n.name)
 	}
 	v, err := n.value.eval(ctx)
 	if err != nil {
+		ctx.bad[n.name] = true
 		return nil, err
 	}
 	if n.unexported {
 		ctx.private[n.name] = v
 	} else {
-		ctx.public[n.name] = v
+		ctx.public.set(n.name, v, n.value.Pos())
 	}
 	return nil, nil
 }
@@ -238,29 +361,168 @@ func (n *assignmentNode) isHidden() bool {
 	return strings.HasPrefix(n.name, ".")
 }
 
-type stringNode string
+type stringNode struct {
+	pos Position
+	s   string
+}
 
 func (s *stringNode) Type() nodeType {
 	return n_string
 }
 
+func (s *stringNode) Pos() Position {
+	return s.pos
+}
+
 func (s *stringNode) parse(p *parser) error {
 	t := p.next()
 	if t.t != t_string {
-		return fmt.Errorf("unexpected %s while looking for string token", t.t)
+		return syntaxErrorf(t.pos, "unexpected %s while looking for string token", t.t)
 	}
-	*s = stringNode(t.s)
+	s.pos = t.pos
+	s.s = t.s
 	return nil
 }
 
 func (s *stringNode) pretty(w io.Writer, prefix string) error {
 	fmt.Fprintf(w, "%sstring:\n", prefix)
-	_, err := fmt.Fprintf(w, "%s%s%s\n", prefix, indent, string(*s))
+	_, err := fmt.Fprintf(w, "%s%s%s\n", prefix, indent, s.s)
 	return err
 }
 
 func (s *stringNode) eval(ctx *context) (interface{}, error) {
-	return string(*s), nil
+	return s.s, nil
+}
+
+// templateNode is a quoted string or heredoc that interpolates values, e.g.,
+// "https://@{host}:@{server/port}/api". A doubled sigil, @@{, stands for a
+// literal @{.
+type templateNode struct {
+	pos   Position
+	src   string
+	parts []templatePart
+}
+
+// templatePart is either a literal run of text or a reference to a value.
+type templatePart struct {
+	text string
+	ref  bool // whether text is the path of a value to be interpolated
+}
+
+func (t *templateNode) Type() nodeType {
+	return n_template
+}
+
+func (t *templateNode) Pos() Position {
+	return t.pos
+}
+
+func (t *templateNode) parse(p *parser) error {
+	tok := p.next()
+	if tok.t != t_template {
+		return syntaxErrorf(tok.pos, "unexpected %s while looking for template token", tok.t)
+	}
+	t.pos = tok.pos
+	t.src = tok.s
+
+	var lit strings.Builder
+	s := tok.s
+	for {
+		i := strings.Index(s, "@{")
+		if i < 0 {
+			lit.WriteString(s)
+			break
+		}
+		if i > 0 && s[i-1] == '@' {
+			// @@{ is an escaped, literal @{
+			lit.WriteString(s[:i])
+			lit.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		lit.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return syntaxErrorf(tok.pos, "parse error: unterminated reference in string: %s", s[i:])
+		}
+		path := strings.TrimSpace(s[i+2 : i+end])
+		if path == "" {
+			return syntaxErrorf(tok.pos, "parse error: empty reference in string")
+		}
+		if lit.Len() > 0 {
+			t.parts = append(t.parts, templatePart{text: lit.String()})
+			lit.Reset()
+		}
+		t.parts = append(t.parts, templatePart{text: path, ref: true})
+		s = s[i+end+1:]
+	}
+	if lit.Len() > 0 {
+		t.parts = append(t.parts, templatePart{text: lit.String()})
+	}
+	return nil
+}
+
+func (t *templateNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%stemplate:\n", prefix)
+	for _, part := range t.parts {
+		if part.ref {
+			fmt.Fprintf(w, "%sref:\n%s%s\n", prefix+indent, prefix+indent+indent, part.text)
+		} else {
+			fmt.Fprintf(w, "%sstring:\n%s%s\n", prefix+indent, prefix+indent+indent, part.text)
+		}
+	}
+	return nil
+}
+
+func (t *templateNode) eval(ctx *context) (interface{}, error) {
+	var buf strings.Builder
+	for _, part := range t.parts {
+		if !part.ref {
+			buf.WriteString(part.text)
+			continue
+		}
+		v, err := ctx.lookup(t.pos, part.text)
+		if err != nil {
+			return nil, err
+		}
+		switch v.(type) {
+		case *Object, List:
+			return nil, evalErrorf(t.pos, part.text, "cannot interpolate @{%s}: value is %s, not a scalar", part.text, describe(v))
+		case nil:
+			return nil, evalErrorf(t.pos, part.text, "cannot interpolate @{%s}: value is null", part.text)
+		}
+		if tm, ok := v.(time.Time); ok {
+			buf.WriteString(formatTime(tm))
+			continue
+		}
+		fmt.Fprint(&buf, v)
+	}
+	return buf.String(), nil
+}
+
+// describe gives a short description of the kind of a value, for use in
+// error messages.
+func describe(v interface{}) string {
+	switch v.(type) {
+	case *Object:
+		return "an object"
+	case List:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case time.Duration:
+		return "a duration"
+	case time.Time:
+		return "a time"
+	case int, float64, complex128:
+		return "a number"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("a %T", v)
+	}
 }
 
 type numberType int
@@ -272,36 +534,42 @@ const (
 )
 
 type numberNode struct {
-	t numberType
-	c complex128
-	i int
-	f float64
+	pos Position
+	t   numberType
+	c   complex128
+	i   int
+	f   float64
 }
 
 func (n *numberNode) Type() nodeType {
 	return n_number
 }
 
+func (n *numberNode) Pos() Position {
+	return n.pos
+}
+
 func (n *numberNode) parse(p *parser) error {
 	t := p.next()
+	n.pos = t.pos
 	switch t.t {
 	case t_real_number:
 		if p.peek().t == t_imaginary_number {
 			n.t = num_complex
 			s := t.s + p.next().s
 			if _, err := fmt.Sscan(s, &n.c); err != nil {
-				return fmt.Errorf("ungood imaginary number format %s: %s", s, err)
+				return syntaxErrorf(t.pos, "ungood imaginary number format %s: %s", s, err)
 			}
 			return nil
 		}
 	case t_imaginary_number:
 		n.t = num_complex
 		if _, err := fmt.Sscan("0+"+t.s, &n.c); err != nil {
-			return fmt.Errorf("ungood imaginary number format %s: %s", t.s, err)
+			return syntaxErrorf(t.pos, "ungood imaginary number format %s: %s", t.s, err)
 		}
 		return nil
 	default:
-		return fmt.Errorf("unexpected %s token while parsing number", t.t)
+		return syntaxErrorf(t.pos, "unexpected %s token while parsing number", t.t)
 	}
 
 	i, err := strconv.ParseInt(t.s, 0, 64)
@@ -318,7 +586,7 @@ func (n *numberNode) parse(p *parser) error {
 		return nil
 	}
 
-	return fmt.Errorf("this token broke the number parser: %s", t)
+	return syntaxErrorf(t.pos, "this token broke the number parser: %s", t)
 }
 
 func (n *numberNode) pretty(w io.Writer, prefix string) error {
@@ -350,22 +618,34 @@ func (n *numberNode) eval(ctx *context) (interface{}, error) {
 	}
 }
 
-type listNode []node
+type listNode struct {
+	pos   Position
+	items []node
+}
 
 func (l *listNode) Type() nodeType {
 	return n_list
 }
 
+func (l *listNode) Pos() Position {
+	return l.pos
+}
+
 func (l *listNode) parse(p *parser) error {
 	if p.peek().t == t_list_end {
 		p.next()
 		return nil
 	}
 
-	if n, err := p.parseValue(); err != nil {
-		return err
+	if n, err := p.parseItem(); err != nil {
+		if err := p.report(err); err != nil {
+			return err
+		}
+		l.items = append(l.items, &badNode{pos: p.peek().pos})
+		p.sync(t_list_end)
+		return nil
 	} else {
-		*l = append(*l, n)
+		l.items = append(l.items, n)
 	}
 
 	switch t := p.peek(); t.t {
@@ -379,7 +659,7 @@ func (l *listNode) parse(p *parser) error {
 
 func (l *listNode) pretty(w io.Writer, prefix string) error {
 	fmt.Fprintf(w, "%slist:\n", prefix)
-	for _, n := range *l {
+	for _, n := range l.items {
 		if err := n.pretty(w, prefix+indent); err != nil {
 			return err
 		}
@@ -388,41 +668,72 @@ func (l *listNode) pretty(w io.Writer, prefix string) error {
 }
 
 func (l *listNode) eval(ctx *context) (interface{}, error) {
-	out := make(List, 0, len(*l))
-	for _, n := range *l {
+	out := make(List, 0, len(l.items))
+	for _, n := range l.items {
 		v, err := n.eval(ctx)
 		if err != nil {
-			return nil, err
+			if err := ctx.report(err); err != nil {
+				return nil, err
+			}
+		}
+		if s, ok := n.(*spreadNode); ok && err == nil {
+			items, ok := v.(List)
+			if !ok {
+				if err := ctx.report(evalErrorf(s.pos, "", "cannot spread %s into a list", describe(v))); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			out = append(out, items...)
+			continue
 		}
 		out = append(out, v)
 	}
 	return out, nil
 }
 
-type objectNode map[string]node
+type objectNode struct {
+	pos     Position
+	items   map[string]node
+	keys    []string      // field names, in source order
+	spreads []*spreadNode // objects that the object extends, in source order
+}
 
 func (o *objectNode) Type() nodeType {
 	return n_object
 }
 
+func (o *objectNode) Pos() Position {
+	return o.pos
+}
+
 func (o *objectNode) parse(p *parser) error {
-	if p.peek().t == t_object_end {
+	switch p.peek().t {
+	case t_object_end:
 		p.next()
 		return nil
+	case t_spread:
+		n := new(spreadNode)
+		if err := n.parse(p); err != nil {
+			return o.recover(p, err)
+		}
+		o.spreads = append(o.spreads, n)
+		return o.parse(p)
 	}
 	if err := p.ensureNext(t_name, "looking for object field name in parseObject"); err != nil {
-		return err
+		return o.recover(p, err)
 	}
 	field_name := p.next().s
 	if err := p.ensureNext(t_object_separator, "looking for object separator in parseObject"); err != nil {
-		return err
+		return o.recover(p, err)
 	}
 	p.next()
 
 	if n, err := p.parseValue(); err != nil {
-		return err
+		o.set(field_name, &badNode{pos: p.peek().pos})
+		return o.recover(p, err)
 	} else {
-		(*o)[field_name] = n
+		o.set(field_name, n)
 	}
 
 	switch t := p.peek(); t.t {
@@ -434,36 +745,134 @@ func (o *objectNode) parse(p *parser) error {
 	}
 }
 
+// set assigns a field of the object, remembering the order in which fields
+// were first defined.
+func (o *objectNode) set(name string, n node) {
+	if _, ok := o.items[name]; !ok {
+		o.keys = append(o.keys, name)
+	}
+	o.items[name] = n
+}
+
+// recover reports an error found while parsing the object and skips ahead to
+// the next field or the end of the object.
+func (o *objectNode) recover(p *parser, err error) error {
+	if err := p.report(err); err != nil {
+		return err
+	}
+	if p.sync(t_object_end) {
+		return nil
+	}
+	if t := p.peek().t; t != t_name && t != t_spread {
+		return nil
+	}
+	return o.parse(p)
+}
+
 func (o *objectNode) pretty(w io.Writer, prefix string) error {
 	fmt.Fprintf(w, "%sobject:\n", prefix)
-	keys := make([]string, 0, len(*o))
-	for key := range *o {
+	keys := make([]string, 0, len(o.items))
+	for key := range o.items {
 		keys = append(keys, key)
 	}
 	sort.Strings(keys)
 	for _, key := range keys {
 		fmt.Fprintf(w, "%s%s:\n", prefix+indent, key)
-		err := (*o)[key].pretty(w, prefix+indent+indent)
+		err := o.items[key].pretty(w, prefix+indent+indent)
 		if err != nil {
 			return err
 		}
 	}
+	for _, n := range o.spreads {
+		if err := n.pretty(w, prefix+indent); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// eval evaluates the object. An object that extends others starts out as the
+// merger of those objects, in the order given, and its own fields are merged
+// on top of that regardless of where they're written: {...@defaults; port: 80}
+// and {port: 80; ...@defaults} are the same object.
 func (o *objectNode) eval(ctx *context) (interface{}, error) {
-	out := Object{items: make(map[string]interface{}, len(*o))}
-	for name, node := range *o {
+	out := newObject()
+	for _, n := range o.spreads {
+		v, err := n.eval(ctx)
+		if err == nil {
+			obj, ok := v.(*Object)
+			if ok {
+				out.merge(obj)
+				continue
+			}
+			err = evalErrorf(n.pos, "", "cannot spread %s into an object", describe(v))
+		}
+		if err := ctx.report(err); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range o.keys {
+		node := o.items[name]
 		v, err := node.eval(ctx)
 		if err != nil {
-			return nil, err
+			if err := ctx.report(err); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		out.items[name] = v
+		if obj, ok := v.(*Object); ok && len(o.spreads) > 0 {
+			fields := newObject()
+			fields.set(name, obj, node.Pos())
+			out.merge(fields)
+			continue
+		}
+		out.set(name, v, node.Pos())
+	}
+	return out, nil
+}
+
+// spreadNode splices the items of an object or list into the object or list
+// that contains it, e.g., {...@defaults; port: 8080} or [...@ports 8080].
+type spreadNode struct {
+	pos   Position
+	value node
+}
+
+func (s *spreadNode) Type() nodeType {
+	return n_spread
+}
+
+func (s *spreadNode) Pos() Position {
+	return s.pos
+}
+
+func (s *spreadNode) parse(p *parser) error {
+	t := p.next()
+	if t.t != t_spread {
+		return syntaxErrorf(t.pos, "unexpected %s token when parsing spread", t.t)
+	}
+	s.pos = t.pos
+	n, err := p.parseValue()
+	if err != nil {
+		return err
 	}
-	return &out, nil
+	s.value = n
+	return nil
+}
+
+func (s *spreadNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%sspread:\n", prefix)
+	return s.value.pretty(w, prefix+indent)
+}
+
+// eval gives the value being spread; it's up to the enclosing list or object
+// to splice it in.
+func (s *spreadNode) eval(ctx *context) (interface{}, error) {
+	return s.value.eval(ctx)
 }
 
 type variableNode struct {
+	pos  Position
 	name string
 }
 
@@ -471,11 +880,16 @@ func (v *variableNode) Type() nodeType {
 	return n_variable
 }
 
+func (v *variableNode) Pos() Position {
+	return v.pos
+}
+
 func (v *variableNode) parse(p *parser) error {
 	t := p.next()
 	if t.t != t_variable {
-		return fmt.Errorf("unexpected %s token when parsing variable", t.t)
+		return syntaxErrorf(t.pos, "unexpected %s token when parsing variable", t.t)
 	}
+	v.pos = t.pos
 	v.name = t.s
 	return nil
 }
@@ -486,70 +900,277 @@ func (v *variableNode) pretty(w io.Writer, prefix string) error {
 	return nil
 }
 
+// eval gives the value that the variable refers to. A variable may refer to a
+// value nested within another, as in @server/port or @servers/0/host.
+//
+// References have value semantics: a reference to an object or list gives a
+// copy of it, so that the value referred to and the value that refers to it
+// never share any part of their structure.
 func (v *variableNode) eval(ctx *context) (interface{}, error) {
-	value, ok := ctx.get(v.name)
-	if !ok {
-		return nil, fmt.Errorf("undefined variable: %s", *v)
+	value, err := ctx.lookup(v.pos, v.name)
+	if err != nil {
+		return nil, err
 	}
-	return value, nil
+	return clone(value), nil
+}
+
+// envNode is a reference to an environment variable, e.g., ${HOME}, with an
+// optional default to be used when the variable is unset or empty, e.g.,
+// ${DB_HOST:-localhost}.
+type envNode struct {
+	pos        Position
+	name       string
+	d_fault    string
+	hasDefault bool
 }
 
-type boolNode bool
+func (e *envNode) Type() nodeType {
+	return n_env
+}
+
+func (e *envNode) Pos() Position {
+	return e.pos
+}
+
+func (e *envNode) parse(p *parser) error {
+	t := p.next()
+	if t.t != t_env {
+		return syntaxErrorf(t.pos, "unexpected %s token when parsing environment variable", t.t)
+	}
+	e.pos = t.pos
+	e.name = t.s
+	if i := strings.Index(t.s, ":-"); i >= 0 {
+		e.name, e.d_fault, e.hasDefault = t.s[:i], t.s[i+2:], true
+	}
+	if e.name == "" {
+		return syntaxErrorf(t.pos, "parse error: missing environment variable name in ${%s}", t.s)
+	}
+	for _, r := range e.name {
+		if !isAlphaNumeric(r) {
+			return syntaxErrorf(t.pos, "parse error: invalid environment variable name: %s", e.name)
+		}
+	}
+	return nil
+}
+
+func (e *envNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%senv:\n", prefix)
+	fmt.Fprintf(w, "%s%s\n", prefix+indent, e.name)
+	if e.hasDefault {
+		fmt.Fprintf(w, "%sdefault:\n", prefix+indent)
+		fmt.Fprintf(w, "%s%s\n", prefix+indent+indent, e.d_fault)
+	}
+	return nil
+}
+
+func (e *envNode) eval(ctx *context) (interface{}, error) {
+	if ctx.env != nil {
+		if v, ok := ctx.env(e.name); ok && (v != "" || !e.hasDefault) {
+			return envValue(v), nil
+		}
+	}
+	if e.hasDefault {
+		return envValue(e.d_fault), nil
+	}
+	if ctx.env == nil {
+		return nil, evalErrorf(e.pos, e.name, "environment variable %s has no default and environment lookups are disabled", e.name)
+	}
+	return nil, evalErrorf(e.pos, e.name, "environment variable %s is not set", e.name)
+}
+
+// envValue interprets the value of an environment variable the way it would
+// be interpreted if it were written bare in a document: as a number, a
+// boolean or a duration if it looks like one, and as a string otherwise.
+// Dates and timestamps are left as strings: they're common in environments
+// as version and release names, and turning them into times would change
+// what existing documents read.
+func envValue(s string) interface{} {
+	if s != strings.TrimSpace(s) {
+		return s
+	}
+	p := newParser(strings.NewReader(s), "")
+	switch p.peek().t {
+	case t_real_number, t_imaginary_number, t_bool, t_duration:
+		n, err := p.parseValue()
+		if err != nil || p.next().t != t_eof {
+			return s
+		}
+		if v, err := n.eval(newContext()); err == nil {
+			return v
+		}
+	}
+	return s
+}
+
+type boolNode struct {
+	pos Position
+	b   bool
+}
 
 func (b *boolNode) Type() nodeType {
 	return n_bool
 }
 
+func (b *boolNode) Pos() Position {
+	return b.pos
+}
+
 func (b *boolNode) parse(p *parser) error {
 	t := p.next()
 	if t.t != t_bool {
-		return fmt.Errorf("unexpected %s token while parsing bool", t.t)
+		return syntaxErrorf(t.pos, "unexpected %s token while parsing bool", t.t)
 	}
+	b.pos = t.pos
 	switch t.s {
 	case "true":
-		*b = true
+		b.b = true
 	case "false":
 	default:
-		return fmt.Errorf("illegal lexeme for bool token: %s", t.s)
+		return syntaxErrorf(t.pos, "illegal lexeme for bool token: %s", t.s)
 	}
 	return nil
 }
 
 func (b *boolNode) pretty(w io.Writer, prefix string) error {
 	fmt.Fprintf(w, "%sbool:\n", prefix)
-	fmt.Fprintf(w, "%s%t\n", prefix+indent, *b)
+	fmt.Fprintf(w, "%s%t\n", prefix+indent, b.b)
 	return nil
 }
 
 func (b *boolNode) eval(ctx *context) (interface{}, error) {
-	return bool(*b), nil
+	return b.b, nil
 }
 
-type durationNode time.Duration
+// nullNode is the null literal. Its value is nil, which Fill and Get treat as
+// explicitly unset.
+type nullNode struct {
+	pos Position
+}
+
+func (n *nullNode) Type() nodeType {
+	return n_null
+}
+
+func (n *nullNode) Pos() Position {
+	return n.pos
+}
+
+func (n *nullNode) parse(p *parser) error {
+	t := p.next()
+	if t.t != t_null {
+		return syntaxErrorf(t.pos, "unexpected %s token while parsing null", t.t)
+	}
+	n.pos = t.pos
+	return nil
+}
+
+func (n *nullNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%snull\n", prefix)
+	return nil
+}
+
+func (n *nullNode) eval(ctx *context) (interface{}, error) {
+	return nil, nil
+}
+
+type durationNode struct {
+	pos Position
+	d   time.Duration
+}
 
 func (d *durationNode) Type() nodeType {
 	return n_duration
 }
 
+func (d *durationNode) Pos() Position {
+	return d.pos
+}
+
 func (d *durationNode) parse(p *parser) error {
 	t := p.next()
 	if t.t != t_duration {
-		return fmt.Errorf("unexpected %s token while parsing duration", t.t)
+		return syntaxErrorf(t.pos, "unexpected %s token while parsing duration", t.t)
 	}
 	v, err := time.ParseDuration(t.s)
 	if err != nil {
-		return fmt.Errorf("unable to parse duration: %s", err)
+		return syntaxErrorf(t.pos, "unable to parse duration: %s", err)
 	}
-	*d = durationNode(v)
+	d.pos = t.pos
+	d.d = v
 	return nil
 }
 
 func (d *durationNode) pretty(w io.Writer, prefix string) error {
 	fmt.Fprintf(w, "%sdur:\n", prefix)
-	fmt.Fprintf(w, "%s%s\n", prefix+indent, time.Duration(*d).String())
+	fmt.Fprintf(w, "%s%s\n", prefix+indent, d.d.String())
 	return nil
 }
 
 func (d *durationNode) eval(ctx *context) (interface{}, error) {
-	return time.Duration(*d), nil
+	return d.d, nil
+}
+
+// timeNode is a date or timestamp, e.g., 2024-05-01 or 2024-05-01T09:30:00Z.
+type timeNode struct {
+	pos Position
+	t   time.Time
+}
+
+func (t *timeNode) Type() nodeType {
+	return n_time
+}
+
+func (t *timeNode) Pos() Position {
+	return t.pos
+}
+
+func (t *timeNode) parse(p *parser) error {
+	tok := p.next()
+	if tok.t != t_timestamp {
+		return syntaxErrorf(tok.pos, "unexpected %s token while parsing timestamp", tok.t)
+	}
+	v, err := parseTime(tok.s)
+	if err != nil {
+		return syntaxErrorf(tok.pos, "%s", err)
+	}
+	t.pos = tok.pos
+	t.t = v
+	return nil
+}
+
+func (t *timeNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%stime:\n", prefix)
+	fmt.Fprintf(w, "%s%s\n", prefix+indent, t.t.Format(time.RFC3339Nano))
+	return nil
+}
+
+func (t *timeNode) eval(ctx *context) (interface{}, error) {
+	return t.t, nil
+}
+
+// badNode stands in for a value that failed to parse. It only appears in
+// trees produced by a parser that is recovering from errors.
+type badNode struct {
+	pos Position
+}
+
+func (b *badNode) Type() nodeType {
+	return n_error
+}
+
+func (b *badNode) Pos() Position {
+	return b.pos
+}
+
+func (b *badNode) parse(p *parser) error {
+	return nil
+}
+
+func (b *badNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%sbad\n", prefix)
+	return nil
+}
+
+func (b *badNode) eval(ctx *context) (interface{}, error) {
+	return nil, errBad
 }
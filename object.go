@@ -30,33 +30,130 @@ import (
 )
 
 // Object is a representation of a Moon object in its native form.  It has no
-// configured options and deals only with opaque types.
+// configured options and deals only with opaque types. An Object remembers the
+// order in which its items were defined, and every encoding of an Object
+// preserves that order.
 type Object struct {
 	items map[string]interface{}
+	keys  []string            // item names, in the order they were defined
+	pos   map[string]Position // where each item was defined, if known
 }
 
-func (o *Object) MarshalJSON() ([]byte, error) {
-	return json.Marshal(o.items)
+func newObject() *Object {
+	return &Object{
+		items: make(map[string]interface{}),
+		pos:   make(map[string]Position),
+	}
 }
 
-func (o *Object) MarshalMoon() ([]byte, error) {
-	var buf bytes.Buffer
+// set assigns the item at key. Assigning to an existing key replaces its value
+// but not its place in the ordering.
+func (o *Object) set(key string, v interface{}, pos Position) {
+	if _, ok := o.items[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.items[key] = v
+	o.pos[key] = pos
+}
+
+// merge assigns every item of src to o, in the order in which they were
+// defined in src. Where both o and src have an object at the same key, the two
+// are merged in turn, so that nested objects are combined rather than replaced.
+// Any other value in src, including a list, replaces the value in o. Neither
+// src nor any object nested within o is modified; merged objects are new.
+func (o *Object) merge(src *Object) {
+	for _, k := range src.keys {
+		v := src.items[k]
+		if dst, ok := o.items[k].(*Object); ok {
+			if obj, ok := v.(*Object); ok {
+				merged := newObject()
+				merged.merge(dst)
+				merged.merge(obj)
+				v = merged
+			}
+		}
+		o.set(k, v, src.pos[k])
+	}
+}
+
+// Clone returns a deep copy of the object: every object and list within it is
+// copied as well, so that changes to the copy never affect the original, and
+// vice versa. A nil *Object clones to nil.
+func (o *Object) Clone() *Object {
+	if o == nil {
+		return nil
+	}
+	c := &Object{
+		items: make(map[string]interface{}, len(o.items)),
+		keys:  make([]string, len(o.keys)),
+		pos:   make(map[string]Position, len(o.pos)),
+	}
+	copy(c.keys, o.keys)
 	for k, v := range o.items {
-		buf.WriteString(k)
-		buf.WriteByte(':')
-		buf.WriteByte(' ')
-		b, err := Encode(v)
+		c.items[k] = clone(v)
+	}
+	for k, pos := range o.pos {
+		c.pos[k] = pos
+	}
+	return c
+}
+
+// clone gives a deep copy of a value from a Moon document. Objects and lists
+// are copied; every other kind of value is immutable, and is returned as is.
+func clone(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *Object:
+		return v.Clone()
+	case List:
+		if v == nil {
+			return v
+		}
+		l := make(List, len(v))
+		for i, item := range v {
+			l[i] = clone(item)
+		}
+		return l
+	default:
+		return v
+	}
+}
+
+// Keys returns the names of the object's items in the order that they were
+// defined.
+func (o *Object) Keys() []string {
+	keys := make([]string, len(o.keys))
+	copy(keys, o.keys)
+	return keys
+}
+
+func (o *Object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, err := json.Marshal(k)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := buf.Write(b); err != nil {
+		buf.Write(kb)
+		buf.WriteByte(':')
+		vb, err := json.Marshal(o.items[k])
+		if err != nil {
 			return nil, err
 		}
-		buf.WriteByte('\n')
+		buf.Write(vb)
 	}
+	buf.WriteByte('}')
 	return buf.Bytes(), nil
 }
 
+// MarshalMoon encodes the object as a Moon document, with one item per line.
+func (o *Object) MarshalMoon() ([]byte, error) {
+	return Marshal(o)
+}
+
 // Get reads a value from the Moon object at a given path, assigning the
 // value to supplied destination pointer. The argument dest MUST be a pointer,
 // otherwise Get will be unable to overwrite the value that it (should) point
@@ -90,33 +187,51 @@ func (o *Object) MarshalMoon() ([]byte, error) {
 // retrieve the item at index 1 in that list, and then read the field named
 // "host" within that item, assigning the value to the address pointed to by
 // the *string named host
+//
+// The value is converted to the type of dest in the same way that Fill
+// converts the values of struct fields: an object can be read into a struct
+// or a map, a list into a slice, and numbers into any numeric type that can
+// hold them. A value that can't be assigned to dest results in a *TypeError.
+// If dest is a pointer to an empty interface, the value is stored as it
+// appears in the document, with objects as *Object and lists as List.
+//
+// A path that isn't found in the object results in an error of type NoValue.
+// A value of null sets dest to its zero value. If dest points to a pointer or
+// an interface, nil says that the value was null, and there's no error;
+// otherwise, Get returns an error wrapping ErrNull, so that null can be told
+// apart from a value that was written out as zero or empty.
 func (o *Object) Get(path string, dest interface{}) error {
+	dv := reflect.ValueOf(dest)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() {
+		return fmt.Errorf("destination is of type %v; a non-nil pointer is required", reflect.TypeOf(dest))
+	}
 	if o.items == nil {
 		return fmt.Errorf("no item found at path %s (object is empty)", path)
 	}
 
-	var v interface{}
 	parts := strings.Split(path, "/")
-
-	v, err := seekValue(path, parts, o)
+	v, pos, err := seekValue(path, parts, o)
 	if err != nil {
 		return err
 	}
 
-	dt := reflect.TypeOf(dest)
-	if dt.Kind() != reflect.Ptr {
-		return fmt.Errorf("destination is of type %v; a pointer type is required", dt)
-	}
-
-	dv := reflect.ValueOf(dest)
 	dve := dv.Elem()
-
-	if reflect.TypeOf(v).Kind() == reflect.Ptr {
-		dve.Set(reflect.ValueOf(v).Elem())
-	} else {
-		dve.Set(reflect.ValueOf(v))
+	if dve.Kind() == reflect.Interface && dve.NumMethod() == 0 {
+		if v == nil {
+			dve.Set(reflect.Zero(dve.Type()))
+		} else {
+			dve.Set(reflect.ValueOf(v))
+		}
+		return nil
+	}
+	if v == nil {
+		dve.Set(reflect.Zero(dve.Type()))
+		if k := dve.Kind(); k == reflect.Ptr || k == reflect.Interface {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrNull, path)
 	}
-	return nil
+	return withPos(decodeValue(v, dve, path), pos)
 }
 
 // Fill takes the raw values from the Moon object and assigns them to the
@@ -126,8 +241,8 @@ func (o *Object) Get(path string, dest interface{}) error {
 func (o *Object) Fill(dest interface{}) error {
 	// dt = destination type
 	dt := reflect.TypeOf(dest)
-	if dt.Kind() != reflect.Ptr {
-		return fmt.Errorf("destination is of type %v (%v); a pointer type is required", dt, dt.Kind())
+	if dt == nil || dt.Kind() != reflect.Ptr || reflect.ValueOf(dest).IsNil() {
+		return fmt.Errorf("destination is of type %v; a non-nil pointer is required", dt)
 	}
 
 	// ensure the pointer points to a struct type
@@ -141,24 +256,40 @@ func (o *Object) Fill(dest interface{}) error {
 	// value of the struct being pointed to
 	v := pv.Elem()
 
-	return o.fillValue(v)
+	return o.fillValue(v, "")
 }
 
-func (o *Object) fillValue(dv reflect.Value) error {
+// fillValue fills the destination value dv with the contents of the object.
+// path is the location of the object within the document, and is used for
+// error reporting.
+func (o *Object) fillValue(dv reflect.Value, path string) error {
 	switch dv.Kind() {
 	case reflect.Struct:
-		// this is fine
+		if dv.Type() == objectType.Elem() {
+			dv.Set(reflect.ValueOf(o).Elem())
+			return nil
+		}
 	case reflect.Ptr:
+		if dv.Type() == objectType {
+			dv.Set(reflect.ValueOf(o))
+			return nil
+		}
 		if dv.IsNil() {
 			dv.Set(reflect.New(dv.Type().Elem()))
 		}
 		dv = dv.Elem()
+		if dv.Kind() != reflect.Struct {
+			return o.fillValue(dv, path)
+		}
+	case reflect.Map:
+		return o.fillMap(dv, path)
 	default:
-		if reflect.TypeOf(o.items).AssignableTo(dv.Type()) {
-			dv.Set(reflect.ValueOf(o.items))
-			return nil
+		return &TypeError{
+			Path:     path,
+			Expected: dv.Type(),
+			Actual:   reflect.TypeOf(o),
+			Err:      fmt.Errorf("moon object can only fillValue to a struct or map value, saw %v (%v)", dv.Type(), dv.Kind()),
 		}
-		return fmt.Errorf("moon object can only fillValue to a struct value, saw %v (%v)", dv.Type(), dv.Kind())
 	}
 
 	// the destination defines the requirements (i.e., the method of unpacking
@@ -168,41 +299,86 @@ func (o *Object) fillValue(dv reflect.Value) error {
 		return fmt.Errorf("unable to gather requirements: %v", err)
 	}
 
-	for fname, req := range reqs {
+	// every problem with the object is reported, not just the first, and
+	// they're reported in the order that the fields are declared.
+	var diags Diagnostics
+	for i := 0; i < dv.NumField(); i++ {
+		fname := dv.Type().Field(i).Name
+		req := reqs[fname]
 		// field value
 		fv := dv.FieldByName(fname)
+		if !fv.CanSet() {
+			// unexported fields are left alone
+			continue
+		}
+		// path of the field within the document
+		fpath := joinPath(path, req.name)
 		// object value
 		ov, ok := o.items[req.name]
 		if !ok {
 			// moon data is missing expected field
 			if req.required {
 				// if the field is required, that's an error
-				return fmt.Errorf("required field missing: %s", fname)
+				diags.add(&RequiredFieldError{Path: fpath, Field: fname})
 			}
 			if req.d_fault != nil {
 				// otherwise, we look for a user-defined default value
-				fv.Set(reflect.ValueOf(req.d_fault))
+				diags.add(decodeValue(req.d_fault, fv, fpath))
 			}
 			continue
 		}
+		if ov == nil && req.required {
+			// null explicitly unsets a value, which a required field can't be
+			diags.add(&RequiredFieldError{Path: fpath, Field: fname, Null: true})
+			continue
+		}
+		diags.add(withPos(decodeValue(ov, fv, fpath), o.pos[req.name]))
+	}
+	return diags.Err()
+}
 
-		switch t_ov := ov.(type) {
-		case *Object:
-			if err := t_ov.fillValue(fv); err != nil {
-				return err
-			}
-		case List:
-			if err := t_ov.fillValue(fv); err != nil {
-				return err
-			}
-		default:
-			if !fv.Type().AssignableTo(reflect.TypeOf(ov)) {
-				return fmt.Errorf("unable to assign field %s: source type %v is not assignable to destination type %v", req.name, reflect.TypeOf(ov), fv.Type())
-			}
-			fv.Set(reflect.ValueOf(ov))
+// fillMap fills the map dv with the items of the object, creating the map if
+// it's nil. The map must have string keys.
+func (o *Object) fillMap(dv reflect.Value, path string) error {
+	mt := dv.Type()
+	if mt.Key().Kind() != reflect.String {
+		return &TypeError{
+			Path:     path,
+			Expected: mt,
+			Actual:   reflect.TypeOf(o),
+			Err:      fmt.Errorf("moon object can only fill maps with string keys, saw %v", mt.Key()),
+		}
+	}
+	if dv.IsNil() {
+		dv.Set(reflect.MakeMapWithSize(mt, len(o.items)))
+	}
+	var diags Diagnostics
+	for _, k := range o.keys {
+		ev := reflect.New(mt.Elem()).Elem()
+		if err := decodeValue(o.items[k], ev, joinPath(path, k)); err != nil {
+			diags.add(withPos(err, o.pos[k]))
+			continue
 		}
+		dv.SetMapIndex(reflect.ValueOf(k).Convert(mt.Key()), ev)
 	}
-	return nil
+	return diags.Err()
+}
+
+// withPos attaches a position to a TypeError that doesn't yet have one. Lists
+// don't record the positions of their elements, so errors found inside of a
+// list are reported at the position of the list itself.
+func withPos(err error, pos Position) error {
+	switch e := err.(type) {
+	case *TypeError:
+		if !e.Pos.IsValid() {
+			e.Pos = pos
+		}
+	case Diagnostics:
+		for _, err := range e {
+			withPos(err, pos)
+		}
+	}
+	return err
 }
 
 // NoValue is the error type returned when attempting to get a value from a
@@ -216,9 +392,17 @@ func (n NoValue) Error() string {
 	return fmt.Sprintf("no value found for path %s", n.relpath)
 }
 
-func seekValue(fullpath string, parts []string, root interface{}) (interface{}, error) {
+func seekValue(fullpath string, parts []string, root interface{}) (interface{}, Position, error) {
+	return seek(fullpath, parts, root, Position{})
+}
+
+// seek finds the value at the path given by parts within root, which is
+// itself found at pos. It also gives the position of the value that it finds;
+// lists don't record the positions of their elements, so list elements are
+// reported at the position of their list.
+func seek(fullpath string, parts []string, root interface{}, pos Position) (interface{}, Position, error) {
 	if len(parts) == 0 {
-		return nil, fmt.Errorf("path is empty")
+		return nil, pos, fmt.Errorf("path is empty")
 	}
 
 	head, tail := parts[0], parts[1:]
@@ -226,30 +410,43 @@ func seekValue(fullpath string, parts []string, root interface{}) (interface{},
 	if err == nil {
 		l, ok := root.(List)
 		if !ok {
-			return nil, fmt.Errorf("can only index a List, root is %s", reflect.TypeOf(root))
+			return nil, pos, &TypeError{
+				Pos:      pos,
+				Path:     fullpath,
+				Expected: reflect.TypeOf(List(nil)),
+				Actual:   reflect.TypeOf(root),
+				Err:      fmt.Errorf("can only index a List, root is %v", reflect.TypeOf(root)),
+			}
 		}
-		if n >= len(l) {
-			return nil, fmt.Errorf("path %s is out of bounds, can't get the %d index from a slice of len %d", fullpath, n, len(l))
+		if n < 0 || n >= len(l) {
+			return nil, pos, NoValue{fullpath, head}
 		}
 		v := l[n]
 		if len(tail) == 0 {
-			return v, nil
+			return v, pos, nil
 		}
-		return seekValue(fullpath, tail, v)
+		return seek(fullpath, tail, v, pos)
 	}
 
 	m, ok := root.(*Object)
 	if !ok {
-		return nil, fmt.Errorf("can only key an Object, root is %v", reflect.TypeOf(root))
+		return nil, pos, &TypeError{
+			Pos:      pos,
+			Path:     fullpath,
+			Expected: reflect.TypeOf(m),
+			Actual:   reflect.TypeOf(root),
+			Err:      fmt.Errorf("can only key an Object, root is %v", reflect.TypeOf(root)),
+		}
 	}
 
 	v, ok := m.items[head]
 	if !ok {
-		return nil, NoValue{fullpath, head}
+		return nil, pos, NoValue{fullpath, head}
 	}
+	pos = m.pos[head]
 
 	if len(tail) == 0 {
-		return v, nil
+		return v, pos, nil
 	}
-	return seekValue(fullpath, tail, v)
+	return seek(fullpath, tail, v, pos)
 }
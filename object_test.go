@@ -1,7 +1,9 @@
 package moon
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -57,7 +59,7 @@ func TestFill(t *testing.T) {
 
 }
 
-func ExampleDoc_Fill() {
+func ExampleObject_Fill() {
 	input := `
     name: jordan
     age: 29
@@ -84,7 +86,7 @@ func ExampleDoc_Fill() {
 	// Output: {jordan 29 Brooklyn}
 }
 
-func ExampleDoc_Get_one() {
+func ExampleObject_Get_one() {
 	input := `
     name: jordan
     age: 29
@@ -106,7 +108,7 @@ func ExampleDoc_Get_one() {
 	// Output: jordan
 }
 
-func ExampleDoc_Get_two() {
+func ExampleObject_Get_two() {
 	input := `
     @todd: {
         name: todd
@@ -170,3 +172,211 @@ func TestFillEmbeds(t *testing.T) {
 		t.Errorf("expected some_data, got %v", dest.Top.Val)
 	}
 }
+
+func TestGetConversions(t *testing.T) {
+	doc, err := ReadString(`
+		port: 5432
+		db: {host: db.example.com; port: 5432; user: admin}
+		ports: [80 443]
+		servers: [{host: a; port: 1} {host: b; port: 2}]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type server struct {
+		Host string `name: host`
+		Port int    `name: port`
+	}
+	var db *server
+	if err := doc.Get("db", &db); err != nil {
+		t.Fatal(err)
+	}
+	if db == nil || db.Host != "db.example.com" || db.Port != 5432 {
+		t.Errorf("bad db config: %+v", db)
+	}
+
+	var ports []uint16
+	if err := doc.Get("ports", &ports); err != nil || !reflect.DeepEqual(ports, []uint16{80, 443}) {
+		t.Errorf("bad ports: %v (%v)", ports, err)
+	}
+
+	var servers []server
+	if err := doc.Get("servers", &servers); err != nil || len(servers) != 2 || servers[1].Host != "b" {
+		t.Errorf("bad servers: %v (%v)", servers, err)
+	}
+
+	var settings map[string]interface{}
+	if err := doc.Get("db", &settings); err != nil || settings["user"] != "admin" {
+		t.Errorf("bad settings: %v (%v)", settings, err)
+	}
+
+	var raw interface{}
+	if err := doc.Get("db", &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw.(*Object); !ok {
+		t.Errorf("expected an *Object, saw %T", raw)
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	doc, err := ReadString("name: jordan\nport: 5432\nlist: [1 x]\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s string
+	err = doc.Get("port", &s)
+	var te *TypeError
+	if !errors.As(err, &te) || te.Path != "port" || te.Pos.Line != 2 {
+		t.Errorf("expected a type error for port on line 2, saw %v", err)
+	}
+
+	var nums []int
+	err = doc.Get("list", &nums)
+	if !errors.As(err, &te) || te.Path != "list/1" || te.Pos.Line != 3 {
+		t.Errorf("expected a type error for list/1 on line 3, saw %v", err)
+	}
+
+	if err := doc.Get("name", s); err == nil {
+		t.Error("expected an error getting into a non-pointer")
+	}
+	if err := doc.Get("name", nil); err == nil {
+		t.Error("expected an error getting into nil")
+	}
+	var sp *string
+	if err := doc.Get("name", sp); err == nil {
+		t.Error("expected an error getting into a nil pointer")
+	}
+	if err := doc.Get("name/0", &s); !errors.As(err, &te) || te.Pos.Line != 1 {
+		t.Errorf("expected a type error indexing a string, saw %v", err)
+	}
+	if err := doc.Fill(nil); err == nil {
+		t.Error("expected an error filling nil")
+	}
+}
+
+func TestNull(t *testing.T) {
+	doc, err := ReadString(`
+		name: null
+		tags: null
+		limits: null
+		port: null
+		list: [1 null; 2]
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var port int
+
+	// null is found, and unsets the destination; a destination that can't
+	// be nil reports that the value was null
+	name := "set"
+	if err := doc.Get("name", &name); !errors.Is(err, ErrNull) || name != "" {
+		t.Errorf("expected null to give an empty string and ErrNull, saw %q (%v)", name, err)
+	}
+	if err := doc.Get("port", &port); !errors.Is(err, ErrNull) || err.Error() != "value is null: port" || port != 0 {
+		t.Errorf("expected null to give 0 and ErrNull, saw %d (%v)", port, err)
+	}
+	tags := []string{"a"}
+	if err := doc.Get("tags", &tags); !errors.Is(err, ErrNull) || tags != nil {
+		t.Errorf("expected null to give a nil slice and ErrNull, saw %v (%v)", tags, err)
+	}
+	namep := &name
+	if err := doc.Get("name", &namep); err != nil || namep != nil {
+		t.Errorf("expected null to give a nil pointer, saw %v (%v)", namep, err)
+	}
+	var raw interface{} = "set"
+	if err := doc.Get("list/1", &raw); err != nil || raw != nil {
+		t.Errorf("expected null to give nil, saw %v (%v)", raw, err)
+	}
+	if err := doc.Get("missing", &raw); !errors.As(err, new(NoValue)) {
+		t.Errorf("expected NoValue for a missing value, saw %v", err)
+	}
+
+	port = 8080
+	dest := struct {
+		Name   *string           `name: name`
+		Tags   []string          `name: tags`
+		Limits map[string]int    `name: limits`
+		Port   *int              `name: port; default: 80`
+		Other  map[string]string `name: other; help: null`
+	}{
+		Name:   &name,
+		Tags:   []string{"a"},
+		Limits: map[string]int{"a": 1},
+		Port:   &port,
+	}
+	if err := doc.Fill(&dest); err != nil {
+		t.Fatal(err)
+	}
+	if dest.Name != nil || dest.Tags != nil || dest.Limits != nil || dest.Port != nil {
+		t.Errorf("expected null to unset every field, saw %+v", dest)
+	}
+
+	var required struct {
+		Name string `name: name; required: true`
+	}
+	err = doc.Fill(&required)
+	var rfe *RequiredFieldError
+	if !errors.As(err, &rfe) || !rfe.Null || err.Error() != "required field is null: name" {
+		t.Errorf("expected a required field error for a null field, saw %v", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	doc, err := ReadString(`
+		server: {host: localhost; ports: [80 443]; tls: {cert: /etc/cert}}
+		copy: @server
+		@hidden: [{a: 1}]
+		list: @hidden
+		list_2: @hidden
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := doc.items["server"].(*Object)
+	copied := doc.items["copy"].(*Object)
+	if server == copied {
+		t.Fatal("a reference to an object should give a copy of it")
+	}
+	server.items["tls"].(*Object).set("cert", "/changed", Position{})
+	server.items["ports"].(List)[0] = 8080
+	var cert string
+	var port int
+	if err := doc.Get("copy/tls/cert", &cert); err != nil || cert != "/etc/cert" {
+		t.Errorf("changing the original changed the copy: %q (%v)", cert, err)
+	}
+	if err := doc.Get("copy/ports/0", &port); err != nil || port != 80 {
+		t.Errorf("changing the original changed the copy: %d (%v)", port, err)
+	}
+
+	l1, l2 := doc.items["list"].(List), doc.items["list_2"].(List)
+	if l1[0] == l2[0] {
+		t.Error("references to a list should each give a copy of it")
+	}
+
+	c := doc.Clone()
+	if !sameValues(doc, c) {
+		t.Errorf("clone differs from the original")
+	}
+	if !reflect.DeepEqual(c.Keys(), doc.Keys()) {
+		t.Errorf("clone has keys %v, original has keys %v", c.Keys(), doc.Keys())
+	}
+	c.items["server"].(*Object).set("host", "example.com", Position{})
+	c.set("extra", 1, Position{})
+	var host string
+	if err := doc.Get("server/host", &host); err != nil || host != "localhost" {
+		t.Errorf("changing the clone changed the original: %q (%v)", host, err)
+	}
+	if len(doc.Keys()) != 4 {
+		t.Errorf("changing the clone changed the original's keys: %v", doc.Keys())
+	}
+
+	var o *Object
+	if o.Clone() != nil {
+		t.Error("expected a nil clone of a nil object")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 )
@@ -14,11 +15,17 @@ var nodes = map[tokenType]func(p *parser) node{
 	t_string:           func(p *parser) node { return new(stringNode) },
 	t_real_number:      func(p *parser) node { return new(numberNode) },
 	t_imaginary_number: func(p *parser) node { return new(numberNode) },
-	t_list_start:       func(p *parser) node { p.next(); return &listNode{} },
-	t_object_start:     func(p *parser) node { p.next(); return &objectNode{} },
+	t_list_start:       func(p *parser) node { return &listNode{pos: p.next().pos} },
+	t_object_start:     func(p *parser) node { return &objectNode{pos: p.next().pos, items: make(map[string]node)} },
 	t_variable:         func(p *parser) node { return new(variableNode) },
 	t_bool:             func(p *parser) node { return new(boolNode) },
+	t_null:             func(p *parser) node { return new(nullNode) },
 	t_duration:         func(p *parser) node { return new(durationNode) },
+	t_timestamp:        func(p *parser) node { return new(timeNode) },
+	t_env:              func(p *parser) node { return new(envNode) },
+	t_template:         func(p *parser) node { return new(templateNode) },
+	t_paren_open:       func(p *parser) node { return new(exprNode) },
+	t_directive:        func(p *parser) node { return new(profileNode) },
 }
 
 // Static path for configuration file. By default, a call to Parse wil look for
@@ -94,7 +101,7 @@ func Parse(dest interface{}) *Object {
 		f, err := os.Open(Path)
 		if err == nil {
 			defer f.Close()
-			o, err := Read(f)
+			o, err := read(f, Path)
 			if err != nil {
 				bail(1, "unable to parse moon config file at path %s: %s", Path, err)
 			}
@@ -103,11 +110,11 @@ func Parse(dest interface{}) *Object {
 	}
 
 	if obj == nil {
-		obj = &Object{items: make(map[string]interface{})}
+		obj = newObject()
 	}
 
-	for k, v := range cliArgs.items {
-		obj.items[k] = v
+	for _, k := range cliArgs.keys {
+		obj.set(k, cliArgs.items[k], cliArgs.pos[k])
 	}
 
 	if err := obj.Fill(dest); err != nil {
@@ -120,58 +127,128 @@ func Parse(dest interface{}) *Object {
 // EOF. The reader is not closed after reading, since it's an io.Reader and not
 // an io.ReadCloser. In the event of error, the state that the source reader
 // will be left in is undefined.
-func Read(r io.Reader) (*Object, error) {
-	tree, err := parse(r)
+//
+// Errors encountered while reading a document are reported in the form
+// line:col: message.
+func Read(r io.Reader, opts ...Option) (*Object, error) {
+	return read(r, "", opts...)
+}
+
+// An Option changes the way in which a document is evaluated. Options may be
+// given to any of the functions that read a document.
+type Option func(*context)
+
+// LookupEnv sets the function used to look up the environment variables that a
+// document refers to with ${NAME}. By default, variables are looked up with
+// os.LookupEnv. A nil function disables lookups entirely, so that the result
+// of reading a document doesn't depend on the environment it's read in: only
+// references that supply a default, as in ${NAME:-default}, may then be used.
+func LookupEnv(fn func(name string) (string, bool)) Option {
+	return func(c *context) { c.env = fn }
+}
+
+// withFS has included documents read from fsys instead of the OS's file
+// system.
+func withFS(fsys fs.FS) Option {
+	return func(c *context) { c.fsys = fsys }
+}
+
+// read reads a document named filename from r.
+func read(r io.Reader, filename string, opts ...Option) (*Object, error) {
+	tree, err := parse(r, filename)
 	if err != nil {
 		return nil, err
 	}
-	ctx := newContext()
+	ctx := newDocContext(filename, opts)
 	if _, err := tree.eval(ctx); err != nil {
-		return nil, fmt.Errorf("eval error: %s\n", err)
+		return nil, err
 	}
-	return &Object{items: ctx.public}, nil
+	return ctx.public, nil
+}
+
+// Check reads a moon document from a given io.Reader and reports every problem
+// found in it. Unlike Read, Check does not stop at the first error: the parser
+// resynchronizes at the next top-level assignment or closing bracket and the
+// evaluator continues past values that fail to evaluate, so that a single pass
+// produces the full list of diagnostics. A document without problems yields an
+// empty list.
+func Check(r io.Reader, opts ...Option) Diagnostics {
+	return check(r, "", opts...)
+}
+
+// CheckFile is like Check, reading the document from the file at the given
+// path.
+func CheckFile(path string, opts ...Option) Diagnostics {
+	f, err := os.Open(path)
+	if err != nil {
+		return Diagnostics{err}
+	}
+	defer f.Close()
+
+	return check(f, path, opts...)
+}
+
+func check(r io.Reader, filename string, opts ...Option) Diagnostics {
+	p := newParser(r, filename)
+	p.recover = true
+	p.parse()
+	ctx := newDocContext(filename, opts)
+	ctx.recover = true
+	p.root.eval(ctx)
+	diags := append(p.diags, ctx.diags...)
+	diags.sort()
+	return diags
 }
 
 // Reads a moon object from a string. This is purely a convenience method;
 // all it does is create a buffer and call the moon.Read function.
-func ReadString(source string) (*Object, error) {
-	return Read(strings.NewReader(source))
+func ReadString(source string, opts ...Option) (*Object, error) {
+	return Read(strings.NewReader(source), opts...)
 }
 
 // Reads a moon object from a slice of bytes. This is purely a concenience
 // method; like ReadString, it simply creates a buffer and calls moon.Read
-func ReadBytes(b []byte) (*Object, error) {
-	return Read(bytes.NewBuffer(b))
+func ReadBytes(b []byte, opts ...Option) (*Object, error) {
+	return Read(bytes.NewBuffer(b), opts...)
 }
 
-func ReadFile(path string) (*Object, error) {
+// Reads a moon object from the file at the given path. Errors encountered
+// while reading the document are reported in the form file:line:col: message.
+func ReadFile(path string, opts ...Option) (*Object, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	return Read(f)
+	return read(f, path, opts...)
 }
 
-func parse(r io.Reader) (node, error) {
-	p := &parser{
-		root:   newRootNode(),
-		input:  lex(r),
-		backup: make([]token, 0, 8),
-	}
+func parse(r io.Reader, filename string) (node, error) {
+	p := newParser(r, filename)
 	if err := p.parse(); err != nil {
 		return nil, err
 	}
 	return p.root, nil
 }
 
+func newParser(r io.Reader, filename string) *parser {
+	return &parser{
+		root:   newRootNode(),
+		input:  lex(r, filename),
+		backup: make([]token, 0, 8),
+	}
+}
+
 // parser (little p) is an actual parser.  It actually does the parsing of a
 // moon document.
 type parser struct {
-	root   node
-	input  chan token
-	backup []token
+	root    node
+	input   *lexer
+	backup  []token
+	recover bool        // whether to keep parsing after an error
+	diags   Diagnostics // errors seen while recovering
+	parens  int         // how many parentheses have been read and not yet closed
 }
 
 func (p *parser) parse() error {
@@ -183,18 +260,19 @@ func (p *parser) parse() error {
 
 // returns the next token and advances the input stream
 func (p *parser) next() token {
+	var t token
 	if len(p.backup) > 0 {
-		t := p.backup[len(p.backup)-1]
+		t = p.backup[len(p.backup)-1]
 		p.backup = p.backup[:len(p.backup)-1]
-		return t
-	}
-SKIP_COMMENTS:
-	t, ok := <-p.input
-	if !ok {
-		return token{t_eof, "eof"}
+	} else {
+		for t = p.input.nextToken(); t.t == t_comment; t = p.input.nextToken() {
+		}
 	}
-	if t.t == t_comment {
-		goto SKIP_COMMENTS
+	switch t.t {
+	case t_paren_open:
+		p.parens++
+	case t_paren_close:
+		p.parens--
 	}
 	return t
 }
@@ -210,15 +288,95 @@ func (p *parser) unread(t token) {
 		p.backup = make([]token, 0, 8)
 	}
 	p.backup = append(p.backup, t)
+	switch t.t {
+	case t_paren_open:
+		p.parens--
+	case t_paren_close:
+		p.parens++
+	}
+}
+
+// report records an error and determines whether parsing may continue. If the
+// parser is not recovering from errors, the error is handed back to the caller
+// to be returned.
+func (p *parser) report(err error) error {
+	if !p.recover {
+		return err
+	}
+	p.diags.add(err)
+	return nil
+}
+
+// sync skips tokens until the parser reaches a point at which it may resume
+// parsing after an error: either the closing token of the enclosing list or
+// object, which is consumed, or the start of a new assignment, which is not.
+// Brackets opened while skipping are balanced along the way. sync reports
+// whether it stopped at the closing token. A closer of t_eof indicates that
+// the parser is at the top level of the document.
+//
+// An error within an expression leaves the rest of the expression unread.
+// Its contents are skipped first, along with any further errors found in
+// them, so that they aren't mistaken for assignments or for the end of the
+// enclosing list or object.
+func (p *parser) sync(closer tokenType) bool {
+	for p.parens > 0 {
+		if t := p.next(); t.t == t_eof {
+			p.unread(t)
+			return false
+		}
+	}
+	depth := 0
+	for {
+		t := p.next()
+		switch t.t {
+		case t_eof:
+			p.unread(t)
+			return false
+		case t_error:
+			p.diags.add(syntaxErrorf(t.pos, "%s", t.s))
+		case t_list_start, t_object_start:
+			depth++
+		case t_list_end, t_object_end:
+			if depth == 0 && t.t == closer {
+				return true
+			}
+			if depth > 0 {
+				depth--
+			}
+		case t_name:
+			if depth == 0 {
+				p.unread(t)
+				return false
+			}
+		case t_variable:
+			if depth == 0 && p.peek().t == t_object_separator {
+				p.unread(t)
+				return false
+			}
+		}
+	}
 }
 
 func (p *parser) ensureNext(tt tokenType, context string) error {
-	if p.peek().t != tt {
-		return fmt.Errorf("unexpected %v in %s: expected %v", p.peek().t, context, tt)
+	if t := p.peek(); t.t != tt {
+		return syntaxErrorf(t.pos, "unexpected %v in %s: expected %v", t.t, context, tt)
 	}
 	return nil
 }
 
+// parseItem parses the next item of a list, which is either a value or a
+// spread of another list.
+func (p *parser) parseItem() (node, error) {
+	if p.peek().t == t_spread {
+		n := new(spreadNode)
+		if err := n.parse(p); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return p.parseValue()
+}
+
 // parse the next value.  This is to be executed in a context where we know we
 // want something that is a value to come next, such as after an equals sign.
 func (p *parser) parseValue() (node, error) {
@@ -226,14 +384,17 @@ func (p *parser) parseValue() (node, error) {
 		t := p.peek()
 		switch t.t {
 		case t_error:
-			return nil, fmt.Errorf("parse error: saw lex error when looking for value: %v", t.s)
+			// consume the error, so that it isn't reported a second time
+			// while resynchronizing
+			p.next()
+			return nil, syntaxErrorf(t.pos, "parse error: saw lex error when looking for value: %v", t.s)
 		case t_eof:
-			return nil, fmt.Errorf("parse error: unexpected eof when looking for value")
+			return nil, syntaxErrorf(t.pos, "parse error: unexpected eof when looking for value")
 		}
 
 		fn, ok := nodes[t.t]
 		if !ok {
-			return nil, fmt.Errorf("parse error: unexpected %v token while looking for value", t.t)
+			return nil, syntaxErrorf(t.pos, "parse error: unexpected %v token while looking for value", t.t)
 		}
 		n := fn(p)
 		if err := n.parse(p); err != nil {
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -32,7 +33,7 @@ func runParseTest(t *testing.T, basepath, inpath, outpath string) {
 	}
 
 	var buf bytes.Buffer
-	root, err := parse(in)
+	root, err := parse(in, inpath)
 	if err != nil {
 		t.Logf("test %d: in: %s out: %s", n, inpath, outpath)
 		t.Errorf("parse error in test %d: %s", n, err)
@@ -63,3 +64,87 @@ func TestParse(t *testing.T) {
 		runParseTest(t, "tests/parse/", fname, strings.Replace(fname, "in", "out", -1))
 	}
 }
+
+var errorPositionTests = []struct {
+	in  string
+	out string
+}{
+	{"a: [1 2\nb: 3", "2:1: parse error: unexpected t_name token while looking for value"},
+	{"a: 1\nb: @nope", "2:4: undefined variable: nope"},
+	{"a: 1\na: 2", "2:1: invalid re-declaration: a"},
+	{"a: {x: 1\n  y z: 2}", "2:3: unexpected t_error in looking for object field name in parseObject: expected t_name"},
+	{"a: \"unterminated", "1:17: parse error: saw lex error when looking for value: unexpected eof in string literal"},
+	{"snowman: ☃ ]", "1:14: parse error: unexpected token type t_list_end while parsing root node"},
+}
+
+func TestErrorPositions(t *testing.T) {
+	for _, test := range errorPositionTests {
+		_, err := ReadString(test.in)
+		if err == nil {
+			t.Errorf("expected error reading %q, saw none", test.in)
+			continue
+		}
+		if err.Error() != test.out {
+			t.Errorf("expected error '%s', saw '%s'", test.out, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	diags := Check(strings.NewReader(`
+    a: [1 2 }
+    b: 3
+    c: {x: 1 y: ] z: @nope}
+    @d: @also_nope
+    e: @d
+    f: ok
+    f: again
+    `))
+	expected := []string{
+		"2:13: parse error: unexpected t_object_end token while looking for value",
+		"4:17: parse error: unexpected t_list_end token while looking for value",
+		"4:22: undefined variable: nope",
+		"5:9: undefined variable: also_nope",
+		"8:5: invalid re-declaration: f",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d diagnostics, saw %d:\n%v", len(expected), len(diags), diags)
+	}
+	for i, err := range diags {
+		if err.Error() != expected[i] {
+			t.Errorf("expected diagnostic '%s', saw '%s'", expected[i], err)
+		}
+	}
+
+	if diags := Check(strings.NewReader("a: 1\nb: [@a 2]")); len(diags) != 0 {
+		t.Errorf("expected no diagnostics for a valid document, saw %v", diags)
+	}
+
+	diags = Check(strings.NewReader("a: 1\nb: @nope\nc: (1 2)\nk: ({a: 1})\no: {k: ({a: 1}); a: 2}\n"))
+	expected = []string{
+		"2:4: undefined variable: nope",
+		"3:7: parse error: unexpected t_real_number token in expression, expected an operator or )",
+		"4:6: parse error: saw lex error while parsing expression: unexpected rune in expression: { (an object in an expression has to come from a variable or a function)",
+		"5:10: parse error: saw lex error while parsing expression: unexpected rune in expression: { (an object in an expression has to come from a variable or a function)",
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d diagnostics, saw %d:\n%v", len(expected), len(diags), diags)
+	}
+	for i, err := range diags {
+		if err.Error() != expected[i] {
+			t.Errorf("expected diagnostic '%s', saw '%s'", expected[i], err)
+		}
+	}
+}
+
+func TestFailedReadDoesNotLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		if _, err := ReadString("a: [1 2 }\nb: 3\nc: 4"); err == nil {
+			t.Fatal("expected a parse error")
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutine count grew from %d to %d after failed reads", before, after)
+	}
+}
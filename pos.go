@@ -0,0 +1,36 @@
+package moon
+
+import (
+	"fmt"
+)
+
+// Position describes a location within a Moon document. Offsets are counted
+// in bytes from the start of the document; lines and columns start at 1.
+// Columns are counted in bytes, as they are in the go/token package.
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
+}
+
+// IsValid reports whether the position refers to an actual location in a
+// document.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// String formats a position as file:line:col, omitting the file name if it
+// is not known.
+func (p Position) String() string {
+	switch {
+	case !p.IsValid() && p.Filename == "":
+		return "-"
+	case !p.IsValid():
+		return p.Filename
+	case p.Filename == "":
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	default:
+		return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+	}
+}
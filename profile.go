@@ -0,0 +1,92 @@
+package moon
+
+import (
+	"fmt"
+	"io"
+)
+
+// A document may hold the settings for several profiles, such as dev,
+// staging and prod, and choose between them with %profile:
+//
+//   replicas: %profile {
+//       dev: 1
+//       prod: 5
+//       default: 2
+//   }
+//
+// The profile is chosen by the program reading the document, with the Profile
+// option. Only the value for the chosen profile is evaluated, so the values
+// for other profiles may refer to things that don't exist in every
+// environment. When the document is read without a profile, or with a profile
+// that isn't listed, the value named default is used.
+
+// Profile selects the profile to be used by the %profile values in a document.
+// The name of the profile is also available to expressions, as profile().
+func Profile(name string) Option {
+	return func(c *context) { c.profile = name }
+}
+
+// profileNode is a value that depends on the profile, e.g.,
+// %profile {dev: 1; prod: 5}.
+type profileNode struct {
+	pos     Position
+	choices *objectNode
+}
+
+func (n *profileNode) Type() nodeType {
+	return n_profile
+}
+
+func (n *profileNode) Pos() Position {
+	return n.pos
+}
+
+func (n *profileNode) parse(p *parser) error {
+	t := p.next()
+	if t.t != t_directive {
+		return syntaxErrorf(t.pos, "unexpected %s token when parsing profile", t.t)
+	}
+	if t.s != "profile" {
+		return syntaxErrorf(t.pos, "parse error: %%%s is not a value", t.s)
+	}
+	n.pos = t.pos
+	if err := p.ensureNext(t_object_start, "%profile"); err != nil {
+		return err
+	}
+	n.choices = nodes[t_object_start](p).(*objectNode)
+	if err := n.choices.parse(p); err != nil {
+		return err
+	}
+	if len(n.choices.spreads) > 0 {
+		return syntaxErrorf(n.choices.spreads[0].pos, "parse error: the choices of a %%profile can't be spread from another object")
+	}
+	return nil
+}
+
+func (n *profileNode) pretty(w io.Writer, prefix string) error {
+	fmt.Fprintf(w, "%sprofile:\n", prefix)
+	return n.choices.pretty(w, prefix+indent)
+}
+
+func (n *profileNode) eval(ctx *context) (interface{}, error) {
+	choice, ok := n.choices.items[ctx.profile]
+	if !ok || ctx.profile == "" {
+		choice, ok = n.choices.items["default"]
+	}
+	if !ok {
+		if ctx.profile == "" {
+			return nil, evalErrorf(n.pos, "", "no profile was selected, and %%profile has no default")
+		}
+		return nil, evalErrorf(n.pos, "", "%%profile has no value for the profile %q, and no default", ctx.profile)
+	}
+	return choice.eval(ctx)
+}
+
+// profile() gives the name of the selected profile, or the empty string if
+// there is none.
+func builtinProfile(ctx *context, args []interface{}) (interface{}, error) {
+	if err := arity(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return ctx.profile, nil
+}
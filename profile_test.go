@@ -0,0 +1,88 @@
+package moon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	src := `
+		replicas: %profile {
+			dev: 1
+			prod: ${MOON_TEST_UNSET}
+			default: 2
+		}
+		name: ("app-" + profile())
+	`
+	tests := []struct {
+		profile  string
+		replicas int
+		name     string
+	}{
+		{"", 2, "app-"},
+		{"dev", 1, "app-dev"},
+		{"staging", 2, "app-staging"},
+	}
+	for _, test := range tests {
+		var opts []Option
+		if test.profile != "" {
+			opts = append(opts, Profile(test.profile))
+		}
+		doc, err := ReadString(src, opts...)
+		if err != nil {
+			t.Errorf("profile %q: %s", test.profile, err)
+			continue
+		}
+		if v := doc.items["replicas"]; v != test.replicas {
+			t.Errorf("profile %q: expected %d replicas, saw %v", test.profile, test.replicas, v)
+		}
+		if v := doc.items["name"]; v != test.name {
+			t.Errorf("profile %q: expected name %q, saw %v", test.profile, test.name, v)
+		}
+	}
+
+	// only the chosen value is evaluated
+	_, err := ReadString(src, Profile("prod"))
+	if err == nil || !strings.Contains(err.Error(), "MOON_TEST_UNSET") {
+		t.Errorf("expected an error for the prod profile, saw %v", err)
+	}
+}
+
+func TestProfileErrors(t *testing.T) {
+	tests := []struct {
+		src     string
+		profile string
+		msg     string
+	}{
+		{`a: %profile {dev: 1}`, "prod", `1:4: %profile has no value for the profile "prod", and no default`},
+		{`a: %profile {dev: 1}`, "", "1:4: no profile was selected, and %profile has no default"},
+		{`a: %profile 1`, "", "1:13: unexpected t_real_number in %profile: expected t_object_start"},
+		{`%profile {dev: 1}`, "", "1:1: parse error: %profile is a value, and must be assigned to a name"},
+		{"@o: {}\na: %profile {...@o}", "", "2:14: parse error: the choices of a %profile can't be spread from another object"},
+	}
+	for _, test := range tests {
+		_, err := ReadString(test.src, Profile(test.profile))
+		if err == nil || err.Error() != test.msg {
+			t.Errorf("%q: expected error %q, saw %v", test.src, test.msg, err)
+		}
+	}
+}
+
+func TestPercentStrings(t *testing.T) {
+	doc, err := ReadString("fmt: %s\nargs: [%d 1]\nnote: %include is a directive\nn: %profile {default: 1}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"fmt":  "%s",
+		"args": List{"%d 1"},
+		"note": "%include is a directive",
+		"n":    1,
+	}
+	for k, v := range expected {
+		if !reflect.DeepEqual(doc.items[k], v) {
+			t.Errorf("%s: expected %#v, saw %#v", k, v, doc.items[k])
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package moon
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
@@ -62,7 +63,7 @@ func field2req(field reflect.StructField) (*req, error) {
 	// this is called by Fill, so we have to do Fill's work by hand, otherwise
 	// they would be mutually recursive.
 
-	errors := map[string]error{
+	errs := map[string]error{
 		"name":     doc.Get("name", &req.name),
 		"help":     doc.Get("help", &req.help),
 		"required": doc.Get("required", &req.required),
@@ -71,12 +72,20 @@ func field2req(field reflect.StructField) (*req, error) {
 		"long":     doc.Get("long", &req.long),
 	}
 
+	// a null name means the same as no name at all
+	if errors.Is(errs["name"], ErrNull) {
+		req.name = field.Name
+	}
+	if errors.Is(errs["long"], ErrNull) {
+		req.long = field.Name
+	}
+
 	if req.long == field.Name && req.name != field.Name {
 		req.long = req.name
 	}
 
-	for fname, err := range errors {
-		if err == nil {
+	for fname, err := range errs {
+		if err == nil || errors.Is(err, ErrNull) {
 			continue
 		}
 		if _, ok := err.(NoValue); !ok {
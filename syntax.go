@@ -0,0 +1,524 @@
+package moon
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// The types in this file describe a Moon document as it was written, rather
+// than what it evaluates to. Every byte of the source is accounted for, either
+// as the text of a token or as the whitespace and semicolons that lead up to
+// a token, so a File can be modified in place and printed back out without
+// disturbing the comments, ordering and layout chosen by whoever wrote it.
+
+// Token is a single lexeme in a Moon document.
+type Token struct {
+	Leading string   // whitespace and separators between the previous token and this one
+	Text    string   // the token's text, exactly as it appears in the source
+	Pos     Position // position of the first byte of Text
+}
+
+func (t *Token) writeTo(buf *bytes.Buffer) {
+	buf.WriteString(t.Leading)
+	buf.WriteString(t.Text)
+}
+
+// Node is an element of the concrete syntax tree produced by ParseFile.
+type Node interface {
+	Pos() Position
+	writeTo(*bytes.Buffer)
+}
+
+// File is the concrete syntax tree of a Moon document.
+type File struct {
+	Name  string // file name, if known
+	Nodes []Node // top-level assignments, directives and comments, in source order
+	EOF   Token  // end of input; its Leading text is whatever trails the last node
+}
+
+func (f *File) Pos() Position {
+	if len(f.Nodes) > 0 {
+		return f.Nodes[0].Pos()
+	}
+	return f.EOF.Pos
+}
+
+func (f *File) writeTo(buf *bytes.Buffer) {
+	for _, n := range f.Nodes {
+		n.writeTo(buf)
+	}
+	f.EOF.writeTo(buf)
+}
+
+// Bytes returns the source text of the file. For a File returned by
+// ParseFile that hasn't been modified, this is the original source, byte for
+// byte.
+func (f *File) Bytes() []byte {
+	var buf bytes.Buffer
+	f.writeTo(&buf)
+	return buf.Bytes()
+}
+
+// WriteTo writes the source text of the file to w.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(f.Bytes())
+	return int64(n), err
+}
+
+// Comment is a comment, from the # to the end of the line.
+type Comment struct {
+	Token
+}
+
+func (c *Comment) Pos() Position { return c.Token.Pos }
+
+// Body returns the text of the comment, without the leading #.
+func (c *Comment) Body() string {
+	return strings.TrimPrefix(c.Token.Text, "#")
+}
+
+// Assignment is a key-value pair, either at the top level of a document or as
+// a field of an object. Assignments to variables (hidden assignments) have
+// names starting with @.
+type Assignment struct {
+	Name  Token
+	Colon Token
+	Value Node
+}
+
+func (a *Assignment) Pos() Position { return a.Name.Pos }
+
+func (a *Assignment) writeTo(buf *bytes.Buffer) {
+	a.Name.writeTo(buf)
+	a.Colon.writeTo(buf)
+	a.Value.writeTo(buf)
+}
+
+// Hidden reports whether the assignment defines a variable that is visible
+// only within the document.
+func (a *Assignment) Hidden() bool {
+	return strings.HasPrefix(a.Name.Text, "@")
+}
+
+// Key returns the name being assigned, with any escapes resolved and without
+// the @ sigil of hidden assignments.
+func (a *Assignment) Key() string {
+	l := lexString(a.Name.Text)
+	return l.nextToken().s
+}
+
+// Directive is an instruction to the reader of a document, such as
+// %include "path", or a value chosen by the reader, such as
+// %profile {dev: 1; prod: 5}. Name is the directive's name, including its %
+// sigil.
+type Directive struct {
+	Name  Token
+	Value Node
+}
+
+func (d *Directive) Pos() Position { return d.Name.Pos }
+
+func (d *Directive) writeTo(buf *bytes.Buffer) {
+	d.Name.writeTo(buf)
+	d.Value.writeTo(buf)
+}
+
+// StringLit is a string value. It may be bare, quoted, or a heredoc.
+type StringLit struct {
+	Token
+}
+
+func (s *StringLit) Pos() Position { return s.Token.Pos }
+
+// Quote returns the delimiter of a quoted string, '<' for a heredoc, or 0
+// for a bare string.
+func (s *StringLit) Quote() byte {
+	switch c := s.Text[0]; c {
+	case '"', '\'', '`', '<':
+		return c
+	default:
+		return 0
+	}
+}
+
+// Label returns the label of a heredoc, without the ~ of an indented heredoc,
+// the @ of an interpolating heredoc or the - that removes its final newline,
+// or the empty string if the string is not a heredoc.
+func (s *StringLit) Label() string {
+	if s.Quote() != '<' {
+		return ""
+	}
+	label := strings.TrimPrefix(s.Text, "<<")
+	if i := strings.IndexByte(label, '\n'); i >= 0 {
+		label = label[:i]
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(label, "~"), "@"), "-")
+}
+
+// NumberLit is a numeric value. Complex numbers with a real part are made up
+// of two tokens, in which case Imag holds the imaginary part.
+type NumberLit struct {
+	Token
+	Imag *Token
+}
+
+func (n *NumberLit) Pos() Position { return n.Token.Pos }
+
+func (n *NumberLit) writeTo(buf *bytes.Buffer) {
+	n.Token.writeTo(buf)
+	if n.Imag != nil {
+		n.Imag.writeTo(buf)
+	}
+}
+
+// BoolLit is a boolean value.
+type BoolLit struct {
+	Token
+}
+
+func (b *BoolLit) Pos() Position { return b.Token.Pos }
+
+// NullLit is the null value.
+type NullLit struct {
+	Token
+}
+
+func (n *NullLit) Pos() Position { return n.Token.Pos }
+
+// DurationLit is a duration value, e.g., 30s.
+type DurationLit struct {
+	Token
+}
+
+func (d *DurationLit) Pos() Position { return d.Token.Pos }
+
+// TimeLit is a date or timestamp value, e.g., 2024-05-01T09:30:00Z.
+type TimeLit struct {
+	Token
+}
+
+func (t *TimeLit) Pos() Position { return t.Token.Pos }
+
+// VariableRef is a reference to a previously assigned value, e.g., @name.
+type VariableRef struct {
+	Token
+}
+
+func (v *VariableRef) Pos() Position { return v.Token.Pos }
+
+// EnvRef is a reference to an environment variable, e.g., ${HOME} or
+// ${DB_HOST:-localhost}.
+type EnvRef struct {
+	Token
+}
+
+func (e *EnvRef) Pos() Position { return e.Token.Pos }
+
+// Spread splices the items of an object or list into the object or list that
+// contains it, e.g., ...@defaults. Token is the ... operator.
+type Spread struct {
+	Token
+	Value Node
+}
+
+func (s *Spread) Pos() Position { return s.Token.Pos }
+
+func (s *Spread) writeTo(buf *bytes.Buffer) {
+	s.Token.writeTo(buf)
+	s.Value.writeTo(buf)
+}
+
+// Expr is a parenthesized expression, e.g., (@workers * 4). Tokens holds the
+// tokens in between the parentheses, nested parentheses and comments
+// included, in source order.
+type Expr struct {
+	Open   Token
+	Tokens []Token
+	Close  Token
+}
+
+func (e *Expr) Pos() Position { return e.Open.Pos }
+
+func (e *Expr) writeTo(buf *bytes.Buffer) {
+	e.Open.writeTo(buf)
+	for i := range e.Tokens {
+		e.Tokens[i].writeTo(buf)
+	}
+	e.Close.writeTo(buf)
+}
+
+// ListLit is a bracketed list of values. Items holds values, spreads and
+// comments in source order.
+type ListLit struct {
+	Open  Token
+	Items []Node
+	Close Token
+}
+
+func (l *ListLit) Pos() Position { return l.Open.Pos }
+
+func (l *ListLit) writeTo(buf *bytes.Buffer) {
+	l.Open.writeTo(buf)
+	for _, n := range l.Items {
+		n.writeTo(buf)
+	}
+	l.Close.writeTo(buf)
+}
+
+// ObjectLit is a braced collection of fields. Fields holds assignments,
+// spreads and comments in source order.
+type ObjectLit struct {
+	Open   Token
+	Fields []Node
+	Close  Token
+}
+
+func (o *ObjectLit) Pos() Position { return o.Open.Pos }
+
+func (o *ObjectLit) writeTo(buf *bytes.Buffer) {
+	o.Open.writeTo(buf)
+	for _, n := range o.Fields {
+		n.writeTo(buf)
+	}
+	o.Close.writeTo(buf)
+}
+
+// ParseFile parses the source of a Moon document into a concrete syntax tree.
+// If src is nil, the source is read from the file named by filename. The
+// filename is also used when reporting positions. ParseFile checks only that
+// the document is syntactically valid; it doesn't evaluate it.
+func ParseFile(filename string, src []byte) (*File, error) {
+	if src == nil {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		src = b
+	}
+	p := &syntaxParser{
+		src:    src,
+		lexer:  lex(bytes.NewReader(src), filename),
+		backup: make([]syntaxToken, 0, 2),
+	}
+	return p.parseFile(filename)
+}
+
+// syntaxToken pairs a token from the lexer with its source text.
+type syntaxToken struct {
+	token
+	Token
+}
+
+// syntaxParser builds concrete syntax trees. Unlike the parser that feeds
+// the evaluator, it keeps comments and tracks the source text in between
+// tokens.
+type syntaxParser struct {
+	src    []byte
+	lexer  *lexer
+	prev   int // end offset of the most recently lexed token
+	backup []syntaxToken
+}
+
+func (p *syntaxParser) next() syntaxToken {
+	if len(p.backup) > 0 {
+		t := p.backup[len(p.backup)-1]
+		p.backup = p.backup[:len(p.backup)-1]
+		return t
+	}
+	t := p.lexer.nextToken()
+	st := syntaxToken{token: t}
+	if t.t != t_error {
+		st.Token = Token{
+			Leading: string(p.src[p.prev:t.pos.Offset]),
+			Text:    string(p.src[t.pos.Offset:t.end]),
+			Pos:     t.pos,
+		}
+		p.prev = t.end
+	}
+	return st
+}
+
+func (p *syntaxParser) peek() syntaxToken {
+	t := p.next()
+	p.unread(t)
+	return t
+}
+
+func (p *syntaxParser) unread(t syntaxToken) {
+	p.backup = append(p.backup, t)
+}
+
+func (p *syntaxParser) unexpected(t syntaxToken, context string) error {
+	if t.t == t_error {
+		return syntaxErrorf(t.pos, "parse error: saw lex error %s: %v", context, t.s)
+	}
+	return syntaxErrorf(t.pos, "parse error: unexpected %v token %s", t.t, context)
+}
+
+func (p *syntaxParser) parseFile(filename string) (*File, error) {
+	f := &File{Name: filename}
+	for {
+		t := p.next()
+		switch t.t {
+		case t_eof:
+			f.EOF = t.Token
+			return f, nil
+		case t_comment:
+			f.Nodes = append(f.Nodes, &Comment{t.Token})
+		case t_name, t_variable:
+			a, err := p.parseAssignment(t)
+			if err != nil {
+				return nil, err
+			}
+			f.Nodes = append(f.Nodes, a)
+		case t_directive:
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			f.Nodes = append(f.Nodes, &Directive{Name: t.Token, Value: v})
+		default:
+			return nil, p.unexpected(t, "while parsing root node")
+		}
+	}
+}
+
+func (p *syntaxParser) parseAssignment(name syntaxToken) (*Assignment, error) {
+	colon := p.next()
+	if colon.t != t_object_separator {
+		return nil, p.unexpected(colon, "after name, expected :")
+	}
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return &Assignment{Name: name.Token, Colon: colon.Token, Value: v}, nil
+}
+
+func (p *syntaxParser) parseValue() (Node, error) {
+	t := p.next()
+	switch t.t {
+	case t_string, t_template:
+		return &StringLit{t.Token}, nil
+	case t_real_number:
+		n := &NumberLit{Token: t.Token}
+		if p.peek().t == t_imaginary_number {
+			imag := p.next().Token
+			n.Imag = &imag
+		}
+		return n, nil
+	case t_imaginary_number:
+		return &NumberLit{Token: t.Token}, nil
+	case t_bool:
+		return &BoolLit{t.Token}, nil
+	case t_null:
+		return &NullLit{t.Token}, nil
+	case t_duration:
+		return &DurationLit{t.Token}, nil
+	case t_timestamp:
+		return &TimeLit{t.Token}, nil
+	case t_variable:
+		return &VariableRef{t.Token}, nil
+	case t_env:
+		return &EnvRef{t.Token}, nil
+	case t_list_start:
+		return p.parseList(t)
+	case t_object_start:
+		return p.parseObject(t)
+	case t_paren_open:
+		return p.parseExpr(t)
+	case t_directive:
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return &Directive{Name: t.Token, Value: v}, nil
+	default:
+		return nil, p.unexpected(t, "while looking for value")
+	}
+}
+
+// parseExpr gathers up the tokens of an expression. The expression's structure
+// is left to the evaluator; all that matters here is where it ends.
+func (p *syntaxParser) parseExpr(open syntaxToken) (*Expr, error) {
+	e := &Expr{Open: open.Token}
+	depth := 1
+	for {
+		t := p.next()
+		switch t.t {
+		case t_eof, t_error:
+			return nil, p.unexpected(t, "in expression")
+		case t_paren_open:
+			depth++
+		case t_paren_close:
+			depth--
+			if depth == 0 {
+				e.Close = t.Token
+				return e, nil
+			}
+		}
+		e.Tokens = append(e.Tokens, t.Token)
+	}
+}
+
+func (p *syntaxParser) parseList(open syntaxToken) (*ListLit, error) {
+	l := &ListLit{Open: open.Token}
+	for {
+		switch t := p.peek(); t.t {
+		case t_list_end:
+			l.Close = p.next().Token
+			return l, nil
+		case t_comment:
+			l.Items = append(l.Items, &Comment{p.next().Token})
+		case t_spread:
+			sp, err := p.parseSpread(p.next())
+			if err != nil {
+				return nil, err
+			}
+			l.Items = append(l.Items, sp)
+		default:
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			l.Items = append(l.Items, v)
+		}
+	}
+}
+
+func (p *syntaxParser) parseObject(open syntaxToken) (*ObjectLit, error) {
+	o := &ObjectLit{Open: open.Token}
+	for {
+		switch t := p.next(); t.t {
+		case t_object_end:
+			o.Close = t.Token
+			return o, nil
+		case t_comment:
+			o.Fields = append(o.Fields, &Comment{t.Token})
+		case t_name:
+			a, err := p.parseAssignment(t)
+			if err != nil {
+				return nil, err
+			}
+			o.Fields = append(o.Fields, a)
+		case t_spread:
+			sp, err := p.parseSpread(t)
+			if err != nil {
+				return nil, err
+			}
+			o.Fields = append(o.Fields, sp)
+		default:
+			return nil, p.unexpected(t, "looking for object field name")
+		}
+	}
+}
+
+func (p *syntaxParser) parseSpread(op syntaxToken) (*Spread, error) {
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return &Spread{Token: op.Token, Value: v}, nil
+}
@@ -0,0 +1,91 @@
+package moon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFileRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("tests/*/*.in")
+	if err != nil {
+		t.Fatalf("unable to find test files: %s", err)
+	}
+	files = append(files, "ex.moon")
+
+	for _, fname := range files {
+		src, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Errorf("unable to read %s: %s", fname, err)
+			continue
+		}
+		if _, err := ReadBytes(src); err != nil {
+			// only valid documents are expected to round-trip
+			continue
+		}
+		f, err := ParseFile(fname, src)
+		if err != nil {
+			t.Errorf("unable to parse %s: %s", fname, err)
+			continue
+		}
+		if out := f.Bytes(); !bytes.Equal(out, src) {
+			t.Errorf("%s did not round-trip", fname)
+			t.Logf("expected:\n%s", src)
+			t.Logf("received:\n%s", out)
+		}
+	}
+}
+
+func TestParseFileEdit(t *testing.T) {
+	src := []byte(`# database settings
+@defaults: {
+    # seconds
+    timeout: 30s
+}
+host: "db.example.com" # primary
+port: 5432
+tables: [users; orders] # that's all
+motd: <<EOF
+hello
+EOF
+`)
+	f, err := ParseFile("", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Nodes) != 8 {
+		t.Fatalf("expected 8 top-level nodes, saw %d", len(f.Nodes))
+	}
+
+	defaults := f.Nodes[1].(*Assignment)
+	if !defaults.Hidden() || defaults.Key() != "defaults" {
+		t.Errorf("expected hidden assignment to defaults, saw %s", defaults.Name.Text)
+	}
+	obj := defaults.Value.(*ObjectLit)
+	if c, ok := obj.Fields[0].(*Comment); !ok || c.Body() != " seconds" {
+		t.Errorf("expected comment inside of object, saw %v", obj.Fields[0])
+	}
+
+	host := f.Nodes[2].(*Assignment)
+	if s := host.Value.(*StringLit); s.Quote() != '"' {
+		t.Errorf("expected a double-quoted string, saw %s", s.Text)
+	}
+
+	motd := f.Nodes[7].(*Assignment)
+	if label := motd.Value.(*StringLit).Label(); label != "EOF" {
+		t.Errorf("expected heredoc label EOF, saw %s", label)
+	}
+	if f, err := ParseFile("", []byte("a: {\n    b: <<~@SQL-\n        x\n    SQL\n}\n")); err != nil {
+		t.Error(err)
+	} else if label := f.Nodes[0].(*Assignment).Value.(*ObjectLit).Fields[0].(*Assignment).Value.(*StringLit).Label(); label != "SQL" {
+		t.Errorf("expected heredoc label SQL, saw %s", label)
+	}
+
+	port := f.Nodes[4].(*Assignment)
+	port.Value.(*NumberLit).Text = "6543"
+	expected := bytes.Replace(src, []byte("5432"), []byte("6543"), 1)
+	if out := f.Bytes(); !bytes.Equal(out, expected) {
+		t.Errorf("edit was not applied cleanly:\n%s", out)
+	}
+}